@@ -1,44 +1,42 @@
 package backtrace
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
-
-	. "github.com/oneclickvirt/defaultset"
+	"time"
 )
 
-type Result struct {
-	i int
-	s string
+// Line 识别出的线路类型
+type Line struct {
+	ASN   string `json:"asn" yaml:"asn"`     // 线路对应的ASN，CN2区分为 AS4809a(GIA) 和 AS4809b(GT)
+	Name  string `json:"name" yaml:"name"`   // 线路名称，如 电信CN2GIA
+	Tier  string `json:"tier" yaml:"tier"`   // 线路等级，如 精品线路
+	Color string `json:"color" yaml:"color"` // 输出时的颜色，如 darkgreen
 }
 
-var (
-	ips = []string{
-		// "219.141.136.12", "202.106.50.1",
-		"219.141.140.10", "202.106.195.68", "221.179.155.161",
-		"202.96.209.133", "210.22.97.1", "211.136.112.200",
-		"58.60.188.222", "210.21.196.6", "120.196.165.24",
-		"61.139.2.69", "119.6.6.6", "211.137.96.205",
-	}
-	names = []string{
-		"北京电信", "北京联通", "北京移动",
-		"上海电信", "上海联通", "上海移动",
-		"广州电信", "广州联通", "广州移动",
-		"成都电信", "成都联通", "成都移动",
-	}
-	m = map[string]string{
-		// [] 前的字符串个数，中文占2个字符串
-		"AS4809a": "电信CN2GIA [精品线路]",
-		"AS4809b": "电信CN2GT  [优质线路]",
-		"AS4134":  "电信163    [普通线路]",
-		"AS9929":  "联通9929   [优质线路]",
-		"AS4837":  "联通4837   [普通线路]",
-		"AS58807": "移动CMIN2  [精品线路]",
-		"AS9808":  "移动CMI    [普通线路]",
-		"AS58453": "移动CMI    [普通线路]",
+// String 返回对齐后的线路描述，[] 前的宽度固定，中文占2个字符宽度
+func (l Line) String() string {
+	pad := 10 - displayWidth(l.Name)
+	if pad < 0 {
+		pad = 0
 	}
-)
+	return fmt.Sprintf("%s%s [%s]", l.Name, strings.Repeat(" ", pad), l.Tier)
+}
+
+func displayWidth(s string) int {
+	w := 0
+	for _, r := range s {
+		if r > 0x7f {
+			w += 2
+		} else {
+			w++
+		}
+	}
+	return w
+}
 
 func removeDuplicates(elements []string) []string {
 	encountered := map[string]bool{} // 用于存储已经遇到的元素
@@ -54,102 +52,143 @@ func removeDuplicates(elements []string) []string {
 	return result // 返回去重后的结果切片
 }
 
-func trace(ch chan Result, i int) {
-	hops, err := Trace(net.ParseIP(ips[i]))
-	if err != nil {
-		s := fmt.Sprintf("%v %-15s %v", names[i], ips[i], err)
-		ch <- Result{i, s}
-		return
+// ipWidth 返回输出时IP地址列的宽度，IPV6地址较长需要单独对齐
+func ipWidth(ip string) int {
+	if strings.Contains(ip, ":") {
+		return 30
 	}
-	var asns []string
-	for _, h := range hops {
-		for _, n := range h.Nodes {
-			asn := ipAsn(n.IP.String())
-			if asn != "" {
-				asns = append(asns, asn)
+	return 15
+}
+
+// traceTarget 使用 engine 对单个目标进行路由追踪，超时时保留已追踪到的跳点，线路由 analyze 识别
+// preflight 大于0时先预检目标及备用地址，使用第一个有响应的地址进行追踪，onHop 不为 nil 时实时回调每一跳
+// multipath 为 true 时使用 DefaultTracer 枚举负载均衡的各条路径，不使用 engine，也不回调 onHop
+func traceTarget(ctx context.Context, t Target, preflight time.Duration, engine Engine, multipath bool, onHop func(r *TraceResult, hop *Hop)) *TraceResult {
+	r := &TraceResult{Target: t, UsedIP: t.IP}
+	if preflight > 0 {
+		r.UsedIP, r.Skipped, r.Unreachable = pickTarget(ctx, t, preflight)
+	}
+	var hook func(hop *Hop)
+	if onHop != nil {
+		hook = func(hop *Hop) { onHop(r, hop) }
+	}
+	if multipath {
+		r.Multipath, r.Err = DefaultTracer.TraceMultipath(ctx, net.ParseIP(r.UsedIP))
+		if r.Multipath != nil {
+			for _, h := range r.Multipath.Hops {
+				if len(h.Nodes) > 0 {
+					r.Hops = append(r.Hops, h)
+				}
 			}
 		}
+	} else {
+		r.Hops, r.Err = engine.Trace(ctx, net.ParseIP(r.UsedIP), hook)
 	}
-	// 处理CN2不同路线的区别
-	if asns != nil && len(asns) > 0 {
-		var tempText string
-		asns = removeDuplicates(asns)
-		tempText += fmt.Sprintf("%v ", names[i])
-		hasAS4134 := false
-		hasAS4809 := false
-		for _, asn := range asns {
-			if asn == "AS4134" {
-				hasAS4134 = true
-			}
-			if asn == "AS4809" {
-				hasAS4809 = true
-			}
+	// 超时或被取消时都保留已追踪到的跳点，照常识别线路
+	if err := ctx.Err(); err != nil && errors.Is(r.Err, err) {
+		r.TimedOut, r.Err = true, nil
+	}
+	r.Done = true
+	return r
+}
+
+// analyze 根据汇聚层之前的跳点识别ASN和线路类型，多路径检测时同时分别识别每条分支
+func (r *TraceResult) analyze(rs *ruleSet) {
+	if r.Err != nil {
+		return
+	}
+	target := r.IP
+	if r.UsedIP != "" {
+		target = r.UsedIP
+	}
+	hops := trimTarget(r.Hops, net.ParseIP(target))
+	if i, b := findBoundary(hops, rs); b != nil {
+		hops, r.Boundary = hops[:i], b
+	}
+	r.ASNs = hopASNs(hops, rs)
+	r.CN2 = classifyCN2(hops, rs)
+	r.Lines = classify(r.ASNs, r.CN2, rs)
+	if r.Multipath == nil {
+		return
+	}
+	for _, p := range r.Multipath.Paths {
+		b := &Branch{Path: p}
+		hops := trimTarget(pathHops(r.Multipath, p), net.ParseIP(target))
+		if i, bd := findBoundary(hops, rs); bd != nil {
+			hops = hops[:i]
 		}
-		// 判断是否包含 AS4134 和 AS4809
-		if hasAS4134 && hasAS4809 {
-			// 同时包含 AS4134 和 AS4809 属于 CN2GT
-			asns = append([]string{"AS4809b"}, asns...)
-		} else if hasAS4809 {
-			// 仅包含 AS4809 属于 CN2GIA
-			asns = append([]string{"AS4809a"}, asns...)
+		b.ASNs = hopASNs(hops, rs)
+		b.CN2 = classifyCN2(hops, rs)
+		b.Lines = classify(b.ASNs, b.CN2, rs)
+		r.Branches = append(r.Branches, b)
+	}
+}
+
+// trimTarget 去掉末尾由目标地址本身应答的跳点，IPV6目标通常位于运营商骨干网的大地址段之内，不能作为骨干网跳点
+func trimTarget(hops []*Hop, target net.IP) []*Hop {
+	for len(hops) > 0 {
+		h := hops[len(hops)-1]
+		if len(h.Nodes) == 0 || !h.Nodes[0].IP.Equal(target) {
+			break
 		}
-		tempText += fmt.Sprintf("%-15s ", ips[i])
-		for _, asn := range asns {
-			asnDescription := m[asn]
-			switch asn {
-			case "":
-				continue
-			case "AS4809": // 被 AS4809a 和 AS4809b 替代了
-				continue
-			case "AS9929":
-				if !strings.Contains(tempText, asnDescription) {
-					tempText += DarkGreen(asnDescription) + " "
-				}
-			case "AS4809a":
-				if !strings.Contains(tempText, asnDescription) {
-					tempText += DarkGreen(asnDescription) + " "
-				}
-			case "AS4809b":
-				if !strings.Contains(tempText, asnDescription) {
-					tempText += Green(asnDescription) + " "
-				}
-			case "AS58807":
-				if !strings.Contains(tempText, asnDescription) {
-					tempText += Green(asnDescription) + " "
-				}
-			default:
-				if !strings.Contains(tempText, asnDescription) {
-					tempText += White(asnDescription) + " "
-				}
+		hops = hops[:len(hops)-1]
+	}
+	return hops
+}
+
+// pathHops 返回多路径中一条分支经过的跳点，没有应答的跳点不包含在内
+func pathHops(m *Multipath, p *Path) []*Hop {
+	var hops []*Hop
+	for i, ip := range p.IPs {
+		if ip == nil {
+			continue
+		}
+		for _, n := range m.Hops[i].Nodes {
+			if n.IP.Equal(ip) {
+				hops = append(hops, &Hop{Nodes: []*Node{n}, Distance: m.Hops[i].Distance})
+				break
 			}
 		}
-		if tempText == (fmt.Sprintf("%v ", names[i]) + fmt.Sprintf("%-15s ", ips[i])) {
-			tempText += fmt.Sprintf("%v", Red("检测不到已知线路的ASN"))
+	}
+	return hops
+}
+
+// hopASNs 按路由顺序返回路径上属于骨干网地址段的ASN，已去重
+// ASN数据源和 NextTrace 查到的ASN只用于展示，不参与线路判断
+func hopASNs(hops []*Hop, rs *ruleSet) []string {
+	var asns []string
+	for _, h := range hops {
+		for _, n := range h.Nodes {
+			if p := rs.lookup(n.IP); p != nil {
+				asns = append(asns, p.ASN)
+			}
 		}
-		ch <- Result{i, tempText}
-	} else {
-		s := fmt.Sprintf("%v %-15s %v", names[i], ips[i], Red("检测不到回程路由节点的IP地址"))
-		ch <- Result{i, s}
 	}
+	return removeDuplicates(asns)
 }
 
-func ipAsn(ip string) string {
-	switch {
-	case strings.HasPrefix(ip, "59.43"):
-		return "AS4809"
-	case strings.HasPrefix(ip, "202.97"):
-		return "AS4134"
-	case strings.HasPrefix(ip, "218.105") || strings.HasPrefix(ip, "210.51"):
-		return "AS9929"
-	case strings.HasPrefix(ip, "219.158"):
-		return "AS4837"
-	case strings.HasPrefix(ip, "223.120.19") || strings.HasPrefix(ip, "223.120.17") || strings.HasPrefix(ip, "223.120.16") ||
-		strings.HasPrefix(ip, "223.120.140") || strings.HasPrefix(ip, "223.120.130") || strings.HasPrefix(ip, "223.120.131") ||
-		strings.HasPrefix(ip, "223.120.141"):
-		return "AS58807"
-	case strings.HasPrefix(ip, "223.118") || strings.HasPrefix(ip, "223.119") || strings.HasPrefix(ip, "223.120") || strings.HasPrefix(ip, "223.121"):
-		return "AS58453"
-	default:
-		return ""
+// classify 根据路径上的ASN识别线路类型，CN2按 cn2 的判断结果区分GIA和GT
+func classify(asns []string, cn2 *CN2Result, rs *ruleSet) []Line {
+	if cn2 != nil {
+		asn := "AS4809a"
+		if cn2.Type == CN2GT {
+			asn = "AS4809b"
+		}
+		asns = append([]string{asn}, asns...)
+	}
+	var result []Line
+	seen := map[string]bool{}
+	for _, asn := range asns {
+		// AS4809 被 AS4809a 和 AS4809b 替代了
+		if asn == "AS4809" {
+			continue
+		}
+		line, ok := lineOf(asn, rs)
+		if !ok || seen[line.String()] {
+			continue
+		}
+		seen[line.String()] = true
+		result = append(result, line)
 	}
+	return result
 }
@@ -0,0 +1,184 @@
+package backtrace
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ASNInfo IP地址的ASN信息
+type ASNInfo struct {
+	ASN     string // ASN，如 AS4134
+	Org     string // 所属组织或运营商名称
+	Country string // 所属国家
+	Prefix  string // 所属地址段，数据源不提供时为空
+	Carrier string // 所属国内运营商，如 电信，非国内运营商时为空
+	Tier    string // 线路等级，如 精品线路，由线路识别规则补全
+}
+
+// ASNSource 提供IP地址ASN信息的数据源，如本地的 mmdb 或 ip2region 数据库
+type ASNSource interface {
+	// Lookup 返回地址的ASN信息，数据源中没有该地址时返回 nil, nil
+	Lookup(ip net.IP) (*ASNInfo, error)
+	Close() error
+}
+
+var (
+	asnSourceMu sync.RWMutex
+	asnSource   ASNSource
+)
+
+// SetASNSource 设置骨干网地址段之外的跳点使用的ASN数据源，为 nil 时只识别骨干网地址段
+// 线路判断仍只依据线路识别规则，数据源只用于补全其余跳点的ASN和组织名称
+func SetASNSource(s ASNSource) {
+	asnSourceMu.Lock()
+	asnSource = s
+	asnSourceMu.Unlock()
+}
+
+func currentASNSource() ASNSource {
+	asnSourceMu.RLock()
+	defer asnSourceMu.RUnlock()
+	return asnSource
+}
+
+// OpenASNDB 按扩展名打开本地ASN数据库，.mmdb 为 MaxMind 格式，.xdb 为 ip2region 格式
+func OpenASNDB(path string) (ASNSource, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mmdb":
+		return OpenMMDB(path)
+	case ".xdb":
+		return OpenXDB(path)
+	default:
+		return nil, fmt.Errorf("unsupported asn database %q, want .mmdb or .xdb", path)
+	}
+}
+
+// getASNInfo 返回地址的ASN信息，骨干网地址段优先，其次为 NextTrace 查到的信息，最后使用ASN数据源，均未收录时返回 nil, nil
+func getASNInfo(ip string) (*ASNInfo, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid ip %q", ip)
+	}
+	return lookupASNInfo(addr, currentRules())
+}
+
+func lookupASNInfo(ip net.IP, rs *ruleSet) (*ASNInfo, error) {
+	if p := rs.lookup(ip); p != nil {
+		return &ASNInfo{ASN: p.ASN, Prefix: p.CIDR, Carrier: p.Carrier, Tier: p.Tier}, nil
+	}
+	// 追踪引擎查到的ASN优先于ASN数据源
+	info := ntraceASN(ip)
+	if info == nil {
+		s := currentASNSource()
+		if s == nil {
+			return nil, nil
+		}
+		var err error
+		if info, err = s.Lookup(ip); err != nil || info == nil {
+			return nil, err
+		}
+	}
+	if l, ok := rs.lines[info.ASN]; ok && info.Tier == "" {
+		info.Tier = l.Tier
+	}
+	return info, nil
+}
+
+// getLineType 返回ASN对应的线路描述，如 电信CN2GIA   [精品线路]，规则中没有该ASN的线路时返回地址段的线路等级
+func getLineType(info ASNInfo) string {
+	if l, ok := lineOf(info.ASN, currentRules()); ok {
+		return l.String()
+	}
+	return info.Tier
+}
+
+// lineOf 返回ASN对应的线路
+// 单个跳点无法区分CN2的GIA和GT，AS4809 按等级较低的GT返回不区分类型的CN2线路
+func lineOf(asn string, rs *ruleSet) (Line, bool) {
+	if l, ok := rs.lines[asn]; ok {
+		return l, true
+	}
+	if asn == "AS4809" {
+		if l, ok := rs.lines["AS4809b"]; ok {
+			l.ASN, l.Name = asn, "电信CN2"
+			return l, true
+		}
+	}
+	return Line{}, false
+}
+
+// ChainSource 依次查询多个数据源，返回第一个查到ASN的结果，如本地数据库未收录时再通过DNS查询
+type ChainSource []ASNSource
+
+// Lookup 实现 ASNSource，所有数据源都没有查到时返回第一个查询错误
+func (c ChainSource) Lookup(ip net.IP) (*ASNInfo, error) {
+	var firstErr error
+	for _, s := range c {
+		info, err := s.Lookup(ip)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if info != nil && info.ASN != "" {
+			return info, nil
+		}
+	}
+	return nil, firstErr
+}
+
+// Prefetch 将前面的数据源未查到ASN的地址交给支持批量查询的数据源
+func (c ChainSource) Prefetch(ips []net.IP) {
+	for _, s := range c {
+		if p, ok := s.(prefetcher); ok {
+			p.Prefetch(ips)
+		}
+		var rest []net.IP
+		for _, ip := range ips {
+			if info, err := s.Lookup(ip); err != nil || info == nil || info.ASN == "" {
+				rest = append(rest, ip)
+			}
+		}
+		ips = rest
+	}
+}
+
+// Close 实现 ASNSource，关闭所有数据源
+func (c ChainSource) Close() error {
+	var errs []error
+	for _, s := range c {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// prefetcher 支持批量查询的ASN数据源，如通过DNS查询的数据源
+type prefetcher interface {
+	Prefetch(ips []net.IP)
+}
+
+// prefetchASNs 对所有结果中不属于骨干网地址段且追踪引擎未提供ASN的跳点批量查询ASN
+func prefetchASNs(results []*TraceResult, rs *ruleSet) {
+	p, ok := currentASNSource().(prefetcher)
+	if !ok {
+		return
+	}
+	var ips []net.IP
+	seen := make(map[string]bool)
+	for _, r := range results {
+		for _, h := range r.Hops {
+			for _, n := range h.Nodes {
+				if s := n.IP.String(); !seen[s] && rs.lookup(n.IP) == nil && ntraceASN(n.IP) == nil {
+					seen[s] = true
+					ips = append(ips, n.IP)
+				}
+			}
+		}
+	}
+	p.Prefetch(ips)
+}
@@ -0,0 +1,102 @@
+package backtrace
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// mapSource 按地址返回固定结果的数据源
+type mapSource struct {
+	infos   map[string]ASNInfo
+	err     error
+	fetched []net.IP
+}
+
+func (s *mapSource) Lookup(ip net.IP) (*ASNInfo, error) {
+	if info, ok := s.infos[ip.String()]; ok {
+		return &info, nil
+	}
+	return nil, s.err
+}
+
+func (s *mapSource) Close() error { return nil }
+
+type prefetchSource struct{ mapSource }
+
+func (s *prefetchSource) Prefetch(ips []net.IP) { s.fetched = append(s.fetched, ips...) }
+
+func TestGetASNInfo(t *testing.T) {
+	local := &mapSource{infos: map[string]ASNInfo{"1.1.1.1": {ASN: "AS13335", Org: "Cloudflare"}}}
+	remote := &prefetchSource{mapSource{
+		infos: map[string]ASNInfo{"1.1.1.1": {ASN: "AS64500"}, "9.9.9.9": {ASN: "AS4837"}},
+		err:   errors.New("remote failed"),
+	}}
+	SetASNSource(ChainSource{local, remote})
+	defer SetASNSource(nil)
+
+	cases := map[string]*ASNInfo{
+		"202.97.1.1": {ASN: "AS4134", Prefix: "202.97.0.0/16", Carrier: "电信", Tier: "普通线路"},
+		"59.43.1.1":  {ASN: "AS4809", Prefix: "59.43.0.0/16", Carrier: "电信"},
+		"1.1.1.1":    {ASN: "AS13335", Org: "Cloudflare"},
+		"9.9.9.9":    {ASN: "AS4837", Tier: "普通线路"},
+	}
+	for ip, want := range cases {
+		got, err := getASNInfo(ip)
+		if err != nil || got == nil || *got != *want {
+			t.Errorf("getASNInfo(%s) = %+v, %v; want %+v", ip, got, err, want)
+		}
+	}
+	if _, err := getASNInfo("8.8.8.8"); err == nil {
+		t.Error("getASNInfo(8.8.8.8) should report the remote error")
+	}
+	if _, err := getASNInfo("bad"); err == nil {
+		t.Error("getASNInfo(bad) should fail")
+	}
+
+	// 本地数据源已查到的地址不再批量查询
+	ChainSource{local, remote}.Prefetch([]net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("9.9.9.9")})
+	if len(remote.fetched) != 1 || remote.fetched[0].String() != "9.9.9.9" {
+		t.Errorf("prefetched %v; want [9.9.9.9]", remote.fetched)
+	}
+}
+
+func TestGetLineType(t *testing.T) {
+	cases := map[string]string{
+		"AS9929":  "优质线路",
+		"AS58807": "精品线路",
+		"AS4809":  "电信CN2",
+		"AS4134":  "普通线路",
+	}
+	for asn, want := range cases {
+		if got := getLineType(ASNInfo{ASN: asn}); !strings.Contains(got, want) {
+			t.Errorf("getLineType(%s) = %q; want it to contain %q", asn, got, want)
+		}
+	}
+	if got := getLineType(ASNInfo{ASN: "AS64500", Tier: "精品线路"}); got != "精品线路" {
+		t.Errorf("getLineType with tier only = %q", got)
+	}
+	if got := getLineType(ASNInfo{ASN: "AS64500"}); got != "" {
+		t.Errorf("getLineType(AS64500) = %q; want empty", got)
+	}
+}
+
+func TestRealtimePrinterOrg(t *testing.T) {
+	SetASNSource(&mapSource{infos: map[string]ASNInfo{"1.1.1.1": {ASN: "AS13335", Org: "Cloudflare"}}})
+	defer SetASNSource(nil)
+	var buf bytes.Buffer
+	old := color.Output
+	color.Output = &buf
+	defer func() { color.Output = old }()
+	hop := &Hop{Distance: 2}
+	hop.Add(&Reply{IP: net.ParseIP("1.1.1.1"), RTT: time.Millisecond})
+	RealtimePrinter(hop, 1, &PrinterConfig{})
+	if out := buf.String(); !strings.Contains(out, "AS13335") || !strings.Contains(out, "Cloudflare") {
+		t.Errorf("got output %q", out)
+	}
+}
@@ -1,29 +1,351 @@
 package backtrace
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"strings"
 	"time"
+
+	. "github.com/oneclickvirt/defaultset"
 )
 
-func BackTrace() {
+const (
+	// DefaultTimeout 未设置 Options.Timeout 时整体检测的超时时间
+	DefaultTimeout = 10 * time.Second
+	// DefaultPreflight 未设置 Options.Preflight 时预检的超时时间
+	DefaultPreflight = time.Second
+)
+
+// Options 回程检测的选项
+type Options struct {
+	IPv4          bool          // 检测IPV4目标
+	IPv6          bool          // 检测IPV6目标
+	Extra         bool          // 同时检测教育网、科技网、广电等其他运营商的目标
+	Preset        string        // 内置目标组的名称，为空时使用 DefaultPreset
+	Targets       []Target      // 自定义目标，设置后不再使用内置目标，IPv4、IPv6、Extra 和 Preset 均不生效
+	Timeout       time.Duration // 整体超时时间，为0时使用 DefaultTimeout
+	TargetTimeout time.Duration // 单个目标的超时时间，为0时仅受整体超时限制
+	Preflight     time.Duration // 预检目标是否响应的超时时间，为0时使用 DefaultPreflight，小于0时不预检
+	Rules         *Rules        // 本次检测使用的线路识别规则，为 nil 时使用 SetRules 设置的当前规则
+	Engine        Engine        // 路由追踪引擎，为 nil 时使用 DefaultEngine
+	Multipath     bool          // 使用 DefaultTracer 枚举负载均衡的各条路径并分别识别线路，不使用 Engine，也不回调 OnHop
+
+	// OnHop 设置后按顺序逐个检测目标，每追踪到一跳即回调，r 为进行中的结果，此时 Timeout 为单个目标的超时时间
+	OnHop func(r *TraceResult, hop *Hop)
+	// OnResult 每个目标识别完成后按目标顺序回调，逐个检测时在下一个目标开始前回调
+	OnResult func(r *TraceResult)
+}
+
+// TraceResult 单个目标的回程检测结果
+type TraceResult struct {
+	Target
+	Hops     []*Hop     // 原始路由跳点及延迟，超时时为已追踪到的部分
+	Boundary *Boundary  // 进入省网汇聚层的边界跳，未检测到时为 nil
+	ASNs     []string   // 按路由顺序识别到的汇聚层之前的ASN
+	CN2      *CN2Result // CN2线路的判断结果及依据，未经过CN2时为 nil
+	Lines    []Line     // 识别出的线路类型
+	Err      error      // 路由追踪失败的原因
+	TimedOut bool       // 是否在追踪完成前超时或被取消
+	Done     bool       // 检测是否已完成
+
+	UsedIP      string    // 实际追踪的地址，目标不响应时为第一个有响应的备用地址
+	Skipped     []Skipped // 预检时因无响应被跳过的地址
+	Unreachable bool      // 预检时目标及备用地址均无响应，此时仍追踪目标地址
+
+	Multipath *Multipath // 多路径检测时负载均衡的路由图
+	Branches  []*Branch  // 多路径检测时各条分支识别出的线路，按发现顺序排列
+}
+
+// Branch 多路径检测时的一条分支及其识别出的线路
+type Branch struct {
+	Path  *Path
+	ASNs  []string
+	CN2   *CN2Result
+	Lines []Line
+}
+
+// Skipped 预检时被跳过的地址及原因
+type Skipped struct {
+	IP     string
+	Reason string
+}
+
+// pickTarget 同时预检目标及备用地址，按优先级返回第一个有响应的地址
+// 优先级更高的地址有响应后不再等待其余地址，均无响应时返回目标地址本身，unreachable 为 true
+func pickTarget(ctx context.Context, t Target, timeout time.Duration) (ip string, skipped []Skipped, unreachable bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ips := append([]string{t.IP}, t.Alternates...)
+	reasons := make([]chan string, len(ips))
+	for i := range ips {
+		reasons[i] = make(chan string, 1)
+		go func(i int) {
+			ok, err := DefaultTracer.Reachable(ctx, net.ParseIP(ips[i]), timeout)
+			switch {
+			case err != nil:
+				reasons[i] <- err.Error()
+			case !ok:
+				reasons[i] <- fmt.Sprintf("%v内无响应", timeout)
+			default:
+				reasons[i] <- ""
+			}
+		}(i)
+	}
+	for i := range ips {
+		reason := <-reasons[i]
+		if reason == "" {
+			return ips[i], skipped, false
+		}
+		skipped = append(skipped, Skipped{ips[i], reason})
+	}
+	return t.IP, skipped, true
+}
+
+// Result 检测协程回传的结果及其在目标列表中的序号
+type Result struct {
+	i int
+	r *TraceResult
+}
+
+// BackTraceContext 并发检测各目标的回程路由并返回结构化结果，结果顺序与目标顺序一致
+// 超时或取消后各目标的路由追踪随之停止，已追踪到的部分标记为 TimedOut
+// opts.Rules 校验失败或 opts.Preset 不存在时返回 error
+func BackTraceContext(ctx context.Context, opts Options) ([]*TraceResult, error) {
+	rs := currentRules()
+	if opts.Rules != nil {
+		var err error
+		if rs, err = compileRules(opts.Rules); err != nil {
+			return nil, err
+		}
+	}
+	list := opts.Targets
+	if len(list) == 0 {
+		var err error
+		if list, err = PresetTargets(opts.Preset, opts.IPv4, opts.IPv6); err != nil {
+			return nil, err
+		}
+		if opts.Extra && opts.IPv4 {
+			list = append(list, targetsExtra...)
+		}
+		if opts.Extra && opts.IPv6 {
+			list = append(list, targetsExtra6...)
+		}
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	preflight := opts.Preflight
+	if preflight == 0 {
+		preflight = DefaultPreflight
+	}
+	if opts.Engine == nil {
+		opts.Engine = DefaultEngine
+	}
+	if opts.OnHop != nil {
+		return traceSequential(ctx, list, opts, rs, timeout, preflight), nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	var (
-		s [12]string // 对应 ips 目标地址数量
-		c = make(chan Result)
-		t = time.After(time.Second * 10)
+		s = make([]*TraceResult, len(list)) // 对应目标地址数量
+		c = make(chan Result, len(list))    // 带缓冲，接收方提前返回时协程也不会阻塞
 	)
-	for i := range ips {
-		go trace(c, i)
+	for i := range list {
+		s[i] = &TraceResult{Target: list[i]}
+		go func(i int) {
+			ctx := ctx
+			if opts.TargetTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, opts.TargetTimeout)
+				defer cancel()
+			}
+			c <- Result{i, traceTarget(ctx, list[i], preflight, opts.Engine, opts.Multipath, nil)}
+		}(i)
 	}
-loop:
+	// 路由追踪会响应 ctx 的结束，因此这里总能等到全部结果
 	for range s {
-		select {
-		case o := <-c:
-			s[o.i] = o.s
-		case <-t:
-			break loop
-		}
+		o := <-c
+		s[o.i] = o.r
 	}
+	// 全部追踪结束后批量查询各跳点的ASN，再识别线路
+	prefetchASNs(s, rs)
 	for _, r := range s {
-		fmt.Println(r)
+		r.analyze(rs)
+		if opts.OnResult != nil {
+			opts.OnResult(r)
+		}
+	}
+	return s, nil
+}
+
+// traceSequential 逐个检测目标，实时回调每一跳，每个目标追踪结束后立即识别线路
+func traceSequential(ctx context.Context, list []Target, opts Options, rs *ruleSet, timeout, preflight time.Duration) []*TraceResult {
+	s := make([]*TraceResult, len(list))
+	for i, t := range list {
+		limit := timeout
+		if opts.TargetTimeout > 0 && opts.TargetTimeout < limit {
+			limit = opts.TargetTimeout
+		}
+		tctx, cancel := context.WithTimeout(ctx, limit)
+		s[i] = traceTarget(tctx, t, preflight, opts.Engine, opts.Multipath, opts.OnHop)
+		cancel()
+		prefetchASNs(s[i:i+1], rs)
+		s[i].analyze(rs)
+		if opts.OnResult != nil {
+			opts.OnResult(s[i])
+		}
+	}
+	return s
+}
+
+// FormatResult 将检测结果渲染为带颜色的单行文本，预检时跳过的地址及原因附在末尾，未完成的目标返回空行
+func FormatResult(r *TraceResult) string {
+	s := formatResult(r)
+	if s == "" || len(r.Skipped) == 0 {
+		return s
+	}
+	skipped := make([]string, len(r.Skipped))
+	for i, sk := range r.Skipped {
+		skipped[i] = sk.IP + " " + sk.Reason
+	}
+	return strings.TrimRight(s, " ") + " " + Yellow("已跳过 "+strings.Join(skipped, "，"))
+}
+
+func formatResult(r *TraceResult) string {
+	if !r.Done {
+		return ""
+	}
+	ip := r.IP
+	if r.UsedIP != "" {
+		ip = r.UsedIP
+	}
+	prefix := fmt.Sprintf("%v %-*s ", r.Name, ipWidth(ip), ip)
+	if r.Err != nil {
+		return fmt.Sprintf("%v%v", prefix, r.Err)
+	}
+	if r.TimedOut && len(r.Lines) == 0 {
+		return fmt.Sprintf("%v%v", prefix, Red(timedOut(r.Hops)))
+	}
+	if len(r.ASNs) == 0 && r.Unreachable {
+		return fmt.Sprintf("%v%v", prefix, Red("检测不到回程路由节点的IP地址，目标及备用地址均无响应"))
+	}
+	if len(r.ASNs) == 0 {
+		return fmt.Sprintf("%v%v", prefix, Red("检测不到回程路由节点的IP地址"))
+	}
+	if len(r.Lines) == 0 {
+		return fmt.Sprintf("%v%v %v", prefix, Red("检测不到已知线路的ASN"), strings.Join(r.ASNs, " "))
+	}
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	for _, l := range r.Lines {
+		sb.WriteString(lineColor(l)(l.String()) + " ")
+	}
+	if r.TimedOut {
+		sb.WriteString(Yellow(timedOut(r.Hops)))
+	}
+	return sb.String()
+}
+
+// FormatMultipath 将多路径检测的结果渲染为多行文本，列出负载均衡的跳点和各条分支的线路
+// 没有发现负载均衡时返回空
+func FormatMultipath(r *TraceResult) string {
+	if r.Multipath == nil || !r.Multipath.IsDiamond() {
+		return ""
+	}
+	var sb strings.Builder
+	for _, h := range r.Multipath.Hops {
+		if len(h.Nodes) < 2 {
+			continue
+		}
+		ips := make([]string, len(h.Nodes))
+		for i, n := range h.Nodes {
+			ips[i] = n.IP.String()
+		}
+		fmt.Fprintf(&sb, "  %v %v\n", Yellow(fmt.Sprintf("第%d跳负载均衡", h.Distance)), strings.Join(ips, " "))
+	}
+	flows := 0
+	for _, b := range r.Branches {
+		flows += b.Path.Flows
+	}
+	for i, b := range r.Branches {
+		fmt.Fprintf(&sb, "  分支%d %d/%d ", i+1, b.Path.Flows, flows)
+		if len(b.Lines) == 0 {
+			sb.WriteString(Red("检测不到已知线路的ASN") + " ")
+		}
+		for _, l := range b.Lines {
+			sb.WriteString(lineColor(l)(l.String()) + " ")
+		}
+		var ips []string
+		for _, ip := range b.Path.IPs {
+			if ip == nil {
+				ips = append(ips, "*")
+			} else {
+				ips = append(ips, ip.String())
+			}
+		}
+		fmt.Fprintf(&sb, "%v\n", strings.Join(ips, " "))
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// timedOut 返回超时提示，注明超时前追踪到的跳数
+func timedOut(hops []*Hop) string {
+	n := 0
+	if len(hops) > 0 {
+		n = hops[len(hops)-1].Distance
+	}
+	return fmt.Sprintf("检测超时，已追踪%d跳", n)
+}
+
+// BackTrace 检测三网回程路由并直接输出结果
+func BackTrace() {
+	opts := Options{
+		IPv4:          EnableIPv4,
+		IPv6:          EnableIPv6,
+		Extra:         EnableExtra,
+		Preset:        Preset,
+		Targets:       Targets,
+		Timeout:       Timeout,
+		TargetTimeout: TargetTimeout,
+		Preflight:     Preflight,
+		Multipath:     EnableMultipath,
+	}
+	grouped := len(Targets) == 0 && presets[Preset].grouped
+	region := ""
+	var started *TraceResult
+	// begin 在每个目标的首行输出前按需输出地区分组，详细模式下同时输出目标名称
+	begin := func(r *TraceResult) {
+		if started == r {
+			return
+		}
+		started = r
+		if rg := RegionOf(r.City); grouped && rg != region {
+			region = rg
+			fmt.Println(Yellow(rg))
+		}
+		if EnableDetail {
+			fmt.Println(Cyan(fmt.Sprintf("%v %v", r.Name, r.UsedIP)))
+		}
+	}
+	opts.OnResult = func(r *TraceResult) {
+		begin(r)
+		fmt.Println(FormatResult(r))
+		if s := FormatMultipath(r); s != "" {
+			fmt.Println(s)
+		}
+		if EnableDetail {
+			fmt.Println()
+		}
+	}
+	if EnableDetail && !EnableMultipath {
+		opts.OnHop = func(r *TraceResult, hop *Hop) {
+			begin(r)
+			RealtimePrinter(hop, hop.Distance-1, &PrinterConfig{DestIP: r.UsedIP})
+		}
+	}
+	if _, err := BackTraceContext(context.Background(), opts); err != nil {
+		fmt.Println(Red(err.Error()))
 	}
 }
@@ -1,7 +1,10 @@
 package backtrace
 
 import (
+	"context"
+	"strings"
 	"testing"
+	"time"
 )
 
 //func TestGeneratePrefixMap(t *testing.T) {
@@ -15,6 +18,189 @@ import (
 //	}
 //}
 
+// withSimTracer 使用模拟网络替换 DefaultTracer，测试不依赖原始套接字和外网
+func withSimTracer(t *testing.T, routes ...SimRoute) {
+	old := DefaultTracer
+	DefaultTracer = newSimTracer(ProbeICMP, routes...)
+	t.Cleanup(func() {
+		DefaultTracer.Close()
+		DefaultTracer = old
+	})
+}
+
+// line 返回当前规则中的线路类型
+func line(asn string) Line {
+	return currentRules().lines[asn]
+}
+
 func TestBackTrace(t *testing.T) {
+	var routes []SimRoute
+	for _, tgt := range targets {
+		routes = append(routes, simRoute(tgt.IP, "10.0.0.1", "10.0.0.2", "202.97.1.1", "202.97.2.1"))
+	}
+	withSimTracer(t, routes...)
 	BackTrace()
 }
+
+func TestBackTraceContext(t *testing.T) {
+	var routes []SimRoute
+	for _, tgt := range targets {
+		routes = append(routes, simRoute(tgt.IP, "10.0.0.1", "10.0.0.2", "219.158.1.1", "219.158.2.1"))
+	}
+	withSimTracer(t, routes...)
+	results, _ := BackTraceContext(context.Background(), Options{IPv4: true})
+	if len(results) != len(targets) {
+		t.Fatalf("got %d results; want %d", len(results), len(targets))
+	}
+	for i, r := range results {
+		if r.IP != targets[i].IP || !r.Done || r.Err != nil {
+			t.Fatalf("result %d: %+v", i, r)
+		}
+		if len(r.ASNs) != 1 || r.ASNs[0] != "AS4837" || len(r.Lines) != 1 || r.Lines[0] != line("AS4837") {
+			t.Errorf("%s: got ASNs %v lines %v", r.Name, r.ASNs, r.Lines)
+		}
+		if len(r.Hops) == 0 {
+			t.Errorf("%s: no hops", r.Name)
+		}
+	}
+}
+
+func TestTraceClassify(t *testing.T) {
+	cases := []struct {
+		route SimRoute
+		want  []Line
+	}{
+		{simRoute("219.141.140.10", "10.0.0.1", "10.0.0.2", "59.43.1.1", "59.43.2.1"), []Line{line("AS4809a")}},
+		{simRoute("202.96.209.133", "10.0.0.1", "10.0.0.2", "59.43.1.1", "202.97.1.1"), []Line{line("AS4809b")}},
+		// 汇聚层之后出现的 202.97 不参与判断
+		{simRoute("61.139.2.69", "10.0.0.1", "59.43.1.1", "61.139.1.1", "202.97.1.1"), []Line{line("AS4809a")}},
+		{simRoute("58.60.188.222", "10.0.0.1", "10.0.0.2", "69.194.1.1", "202.97.1.1"), []Line{line("AS23764")}},
+		{simRoute("202.106.195.68", "10.0.0.1", "10.0.0.2", "219.158.1.1"), []Line{line("AS4837")}},
+		{simRoute("210.22.97.1", "10.0.0.1", "10.0.0.2", "218.105.1.1"), []Line{line("AS9929")}},
+		// 经 CUG 回程再接入 4837 时两条线路都显示
+		{simRoute("210.21.196.6", "10.0.0.1", "43.252.86.1", "219.158.1.1"), []Line{line("AS10099"), line("AS4837")}},
+		{simRoute("119.6.6.6", "10.0.0.1", "202.77.18.41", "218.105.1.1"), []Line{line("AS10099"), line("AS9929")}},
+		{simRoute("101.6.6.6", "10.0.0.1", "202.97.1.1", "101.4.1.1"), []Line{line("AS4538")}},
+		{simRoute("159.226.8.6", "10.0.0.1", "159.226.1.1"), []Line{line("AS7497")}},
+		{simRoute("211.167.230.100", "10.0.0.1", "211.156.130.1"), []Line{line("AS24139")}},
+		{simRoute("2001:da8::666", "fd00::1", "2001:da8:1::1"), []Line{line("AS23910")}},
+		{simRoute("240e:56:4000:8000::69", "fd00::1", "2400:9380:1::1", "2400:9380:2::1"), []Line{line("AS4809a")}},
+		{simRoute("2408:8662::2", "fd00::1", "2401:3480:1::1"), []Line{line("AS9929")}},
+		{simRoute("2409:8062:2000:1::1", "fd00::1", "2402:4f00:4001::1"), []Line{line("AS58807")}},
+		{simRoute("211.136.112.200", "10.0.0.1", "10.0.0.2", "223.120.130.1"), []Line{line("AS58807")}},
+		{simRoute("211.137.96.205", "10.0.0.1", "10.0.0.2", "223.119.1.1"), []Line{line("AS58453")}},
+	}
+	var routes []SimRoute
+	for _, c := range cases {
+		routes = append(routes, c.route)
+	}
+	withSimTracer(t, routes...)
+	for _, c := range cases {
+		r := traceTarget(context.Background(), Target{Name: "test", IP: c.route.Dst}, 0, LocalEngine{}, false, nil)
+		r.analyze(currentRules())
+		s := FormatResult(r)
+		for _, want := range c.want {
+			if !strings.Contains(s, want.String()) {
+				t.Errorf("%s: got %q; want %q", c.route.Dst, s, want.String())
+			}
+		}
+	}
+}
+
+func TestBackTraceTimeout(t *testing.T) {
+	var routes []SimRoute
+	for _, tgt := range targets {
+		r := simRoute(tgt.IP, "10.0.0.1", "10.0.0.2", "202.97.1.1", "202.97.2.1")
+		r.Silent = true
+		routes = append(routes, r)
+	}
+	withSimTracer(t, routes...)
+	results, _ := BackTraceContext(context.Background(), Options{IPv4: true, TargetTimeout: 40 * time.Millisecond, Preflight: -1})
+	for _, r := range results {
+		if !r.TimedOut || r.Err != nil {
+			t.Fatalf("%s: got TimedOut %v err %v; want timeout", r.Name, r.TimedOut, r.Err)
+		}
+		if len(r.Lines) != 1 || r.Lines[0] != line("AS4134") {
+			t.Errorf("%s: got lines %v from partial hops", r.Name, r.Lines)
+		}
+		if s := FormatResult(r); !strings.Contains(s, "检测超时，已追踪4跳") {
+			t.Errorf("%s: got %q", r.Name, s)
+		}
+	}
+}
+
+func TestBackTraceCancel(t *testing.T) {
+	var routes []SimRoute
+	for _, tgt := range targets {
+		r := simRoute(tgt.IP, "10.0.0.1", "10.0.0.2", "202.97.1.1", "202.97.2.1")
+		r.Silent = true
+		routes = append(routes, r)
+	}
+	withSimTracer(t, routes...)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(40*time.Millisecond, cancel)
+	results, _ := BackTraceContext(ctx, Options{IPv4: true, Preflight: -1})
+	for _, r := range results {
+		if !r.TimedOut || r.Err != nil {
+			t.Fatalf("%s: got TimedOut %v err %v; want partial hops kept", r.Name, r.TimedOut, r.Err)
+		}
+		if len(r.Lines) != 1 || r.Lines[0] != line("AS4134") {
+			t.Errorf("%s: got lines %v from partial hops", r.Name, r.Lines)
+		}
+	}
+}
+
+func TestBackTraceOnHop(t *testing.T) {
+	list := []Target{{"办公室", "192.0.2.10", "电信", "杭州", nil}, {"机房", "192.0.2.20", "联通", "深圳", nil}}
+	withSimTracer(t, simRoute(list[0].IP, "10.0.0.1", "202.97.1.1"), simRoute(list[1].IP, "10.0.0.1", "219.158.1.1"))
+	var events []string
+	results, err := BackTraceContext(context.Background(), Options{
+		Targets:   list,
+		Preflight: -1,
+		OnHop: func(r *TraceResult, hop *Hop) {
+			events = append(events, r.Name+" hop")
+		},
+		OnResult: func(r *TraceResult) {
+			events = append(events, r.Name+" "+r.Lines[0].Name)
+		},
+	})
+	if err != nil || len(results) != 2 {
+		t.Fatalf("got %v, %v", results, err)
+	}
+	want := "办公室 hop,办公室 hop,办公室 电信163,机房 hop,机房 hop,机房 联通4837"
+	if got := strings.Join(events, ","); got != want {
+		t.Errorf("got events %s; want %s", got, want)
+	}
+}
+
+func TestBackTraceMultipath(t *testing.T) {
+	route := simRoute("202.96.209.133", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4")
+	route.Hops[2].IPs = []string{"59.43.1.1", "202.97.1.1"}
+	withSimTracer(t, route)
+	results, err := BackTraceContext(context.Background(), Options{
+		Targets:   []Target{{"上海电信", route.Dst, "电信", "上海", nil}},
+		Preflight: -1,
+		Multipath: true,
+	})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("got %v, %v", results, err)
+	}
+	r := results[0]
+	if r.Err != nil || len(r.Branches) != 2 {
+		t.Fatalf("got %d branches, err %v", len(r.Branches), r.Err)
+	}
+	// 两条分支分别经过 CN2 和 163
+	var got []string
+	for _, b := range r.Branches {
+		if len(b.Lines) != 1 {
+			t.Fatalf("branch %v got lines %v", b.Path.IPs, b.Lines)
+		}
+		got = append(got, b.Lines[0].Name)
+	}
+	if !strings.Contains(strings.Join(got, ","), line("AS4134").Name) || !strings.Contains(strings.Join(got, ","), "CN2") {
+		t.Errorf("got branch lines %v", got)
+	}
+	if s := FormatMultipath(r); strings.Count(s, "\n") != 2 || !strings.Contains(s, "第3跳负载均衡") {
+		t.Errorf("FormatMultipath =\n%s", s)
+	}
+}
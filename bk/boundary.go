@@ -0,0 +1,111 @@
+package backtrace
+
+import (
+	"net"
+	"time"
+)
+
+// plateauRTT 汇聚层之后延迟基本不再增加，之后的骨干网跳点延迟增加超过该值时认为路由仍在骨干网上
+const plateauRTT = 5 * time.Millisecond
+
+// Boundary 路由进入目标省网(汇聚层)的位置，之后的跳点不再参与线路判断
+type Boundary struct {
+	Distance int           // 边界跳的跳数
+	IP       net.IP        // 边界跳的地址
+	RTT      time.Duration // 边界跳的最小延迟
+	ASN      string        // 边界前最后一个骨干网跳点的ASN
+	ToASN    string        // ASN数据源或 NextTrace 查到的边界跳的ASN，未查到时为空
+}
+
+// findBoundary 查找路由离开骨干网进入省网的边界跳，返回其在 hops 中的下标
+// 经过骨干网地址段后，第一个不属于骨干网的公网跳点作为候选边界
+// 若之后又出现骨干网跳点且延迟明显增加，说明候选边界只是骨干网中未收录的节点，继续向后查找
+// 若之后的骨干网跳点延迟与候选边界相当，说明已在省网内，这些跳点被忽略
+// ASN数据源或 NextTrace 查到的ASN可以确定跳点是否仍在骨干网上：属于已知线路的ASN按骨干网跳点处理，
+// 候选边界属于其他ASN时边界即可确定，不再因之后的骨干网跳点向后查找
+// 未经过骨干网或没有离开骨干网时返回 -1
+func findBoundary(hops []*Hop, rs *ruleSet) (int, *Boundary) {
+	var (
+		idx     = -1
+		b       *Boundary
+		lastASN string
+	)
+	for i, h := range hops {
+		asn := hopASN(h, rs)
+		known := ""
+		if asn == "" {
+			if known = sourceASN(h, rs); known != "" {
+				if _, ok := lineOf(known, rs); ok {
+					asn = known
+				}
+			}
+		}
+		switch {
+		case asn != "":
+			if b != nil && b.ToASN == "" && hopRTT(h) > b.RTT+plateauRTT {
+				idx, b = -1, nil
+			}
+			if b == nil {
+				lastASN = asn
+			}
+		case lastASN != "" && b == nil:
+			if ip := publicIP(h); ip != nil {
+				idx, b = i, &Boundary{Distance: h.Distance, IP: ip, RTT: hopRTT(h), ASN: lastASN, ToASN: known}
+			}
+		}
+	}
+	return idx, b
+}
+
+// hopASN 返回跳点中第一个属于骨干网地址段的节点的ASN
+func hopASN(h *Hop, rs *ruleSet) string {
+	for _, n := range h.Nodes {
+		if p := rs.lookup(n.IP); p != nil {
+			return p.ASN
+		}
+	}
+	return ""
+}
+
+// sourceASN 返回跳点中第一个由ASN数据源或 NextTrace 查到ASN的公网节点的ASN，均未查到时返回空
+func sourceASN(h *Hop, rs *ruleSet) string {
+	for _, n := range h.Nodes {
+		if !isPublicIP(n.IP) {
+			continue
+		}
+		if info, _ := lookupASNInfo(n.IP, rs); info != nil && info.ASN != "" {
+			return info.ASN
+		}
+	}
+	return ""
+}
+
+// hopRTT 返回跳点所有节点中的最小延迟
+func hopRTT(h *Hop) time.Duration {
+	var min time.Duration
+	for _, n := range h.Nodes {
+		for _, rtt := range n.RTT {
+			if min == 0 || rtt < min {
+				min = rtt
+			}
+		}
+	}
+	return min
+}
+
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP 返回跳点中第一个公网地址，内网和运营商级NAT地址的跳点不作为边界
+func publicIP(h *Hop) net.IP {
+	for _, n := range h.Nodes {
+		if isPublicIP(n.IP) {
+			return n.IP
+		}
+	}
+	return nil
+}
+
+// isPublicIP 判断是否为公网地址，内网、环回、链路本地和运营商级NAT地址不是公网地址
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified() && !cgnat.Contains(ip)
+}
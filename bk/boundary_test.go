@@ -0,0 +1,72 @@
+package backtrace
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testHops 按 地址,延迟毫秒 构造跳点
+func testHops(hops ...interface{}) []*Hop {
+	var list []*Hop
+	for i := 0; i < len(hops); i += 2 {
+		list = append(list, &Hop{
+			Distance: i/2 + 1,
+			Nodes: []*Node{{
+				IP:  net.ParseIP(hops[i].(string)),
+				RTT: []time.Duration{time.Duration(hops[i+1].(int)) * time.Millisecond},
+			}},
+		})
+	}
+	return list
+}
+
+func TestFindBoundary(t *testing.T) {
+	cases := []struct {
+		name string
+		hops []*Hop
+		want string
+	}{
+		{"plateau", testHops("10.0.0.1", 1, "202.97.1.1", 30, "61.139.1.1", 31, "202.97.2.1", 33, "61.139.2.69", 33), "61.139.1.1"},
+		{"unlisted backbone node", testHops("10.0.0.1", 1, "59.43.1.1", 30, "1.2.3.4", 31, "59.43.2.1", 80, "61.139.1.1", 81), "61.139.1.1"},
+		{"private hops", testHops("10.0.0.1", 1, "202.97.1.1", 30, "100.64.1.1", 31, "61.139.1.1", 32), "61.139.1.1"},
+		{"no backbone", testHops("10.0.0.1", 1, "61.139.1.1", 30, "61.139.2.69", 31), ""},
+		{"ends in backbone", testHops("10.0.0.1", 1, "202.97.1.1", 30, "202.97.2.1", 31), ""},
+	}
+	for _, c := range cases {
+		i, b := findBoundary(c.hops, currentRules())
+		if c.want == "" {
+			if b != nil || i != -1 {
+				t.Errorf("%s: got boundary %v at %d; want none", c.name, b.IP, i)
+			}
+			continue
+		}
+		if b == nil || b.IP.String() != c.want || c.hops[i].Distance != b.Distance {
+			t.Errorf("%s: got boundary %+v at %d; want %s", c.name, b, i, c.want)
+		}
+	}
+}
+
+func TestFindBoundarySourceASN(t *testing.T) {
+	SetASNSource(&mapSource{infos: map[string]ASNInfo{
+		"1.2.3.4":    {ASN: "AS4134"},
+		"61.139.1.1": {ASN: "AS38283"},
+	}})
+	defer SetASNSource(nil)
+	cases := []struct {
+		name string
+		hops []*Hop
+		want string
+	}{
+		// 数据源认为是骨干网的未收录节点不作为边界
+		{"backbone by source", testHops("10.0.0.1", 1, "202.97.1.1", 30, "1.2.3.4", 31, "61.139.2.1", 32), "61.139.2.1"},
+		// 已确定进入其他ASN后，之后延迟增加的骨干网跳点不再改变边界
+		{"transition by source", testHops("10.0.0.1", 1, "202.97.1.1", 30, "61.139.1.1", 31, "202.97.2.1", 80, "61.139.2.1", 81), "61.139.1.1"},
+	}
+	for _, c := range cases {
+		_, b := findBoundary(c.hops, currentRules())
+		if b == nil || b.IP.String() != c.want {
+			t.Errorf("%s: got boundary %+v; want %s", c.name, b, c.want)
+		}
+	}
+}
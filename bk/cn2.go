@@ -0,0 +1,109 @@
+package backtrace
+
+import "net"
+
+// CN2线路类型
+const (
+	CN2GIA = "GIA"
+	CN2GT  = "GT"
+)
+
+// CN2Result CN2线路的判断结果
+type CN2Result struct {
+	Type       string     // CN2GIA 或 CN2GT
+	Confidence float64    // 判断的可信程度，0 到 1
+	Evidence   []Evidence // 作为判断依据的跳点
+}
+
+// Evidence 作为判断依据的跳点
+type Evidence struct {
+	Distance int
+	IP       net.IP
+	ASN      string
+	Note     string // 该跳点在判断中的作用，如 CN2起点
+}
+
+// hopEntry 按路由顺序展开的节点，同一跳有多个节点时依次排列
+type hopEntry struct {
+	distance int
+	ip       net.IP
+	asn      string
+}
+
+// classifyCN2 根据路由顺序判断CN2线路类型，hops 应为汇聚层之前的跳点，路径上没有 AS4809 时返回 nil
+// 59.43 段之后出现 202.97 说明国内部分走的是163，为GT，可信度最高
+// 163 夹在 59.43 段中间或只出现在 59.43 段之前时同样判断为GT，可信度依次降低
+// 没有 202.97 时为GIA，59.43 段越长且一直延续到省网边界，可信度越高
+func classifyCN2(hops []*Hop, rs *ruleSet) *CN2Result {
+	var (
+		entries     []hopEntry
+		first, last = -1, -1
+	)
+	for _, h := range hops {
+		for _, n := range h.Nodes {
+			e := hopEntry{distance: h.Distance, ip: n.IP}
+			if p := rs.lookup(n.IP); p != nil {
+				e.asn = p.ASN
+			}
+			if e.asn == "AS4809" {
+				if first < 0 {
+					first = len(entries)
+				}
+				last = len(entries)
+			}
+			entries = append(entries, e)
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+	evidence := func(i int, note string) Evidence {
+		e := entries[i]
+		return Evidence{Distance: e.distance, IP: e.ip, ASN: e.asn, Note: note}
+	}
+	r := &CN2Result{Evidence: []Evidence{evidence(first, "CN2起点")}}
+	if last != first {
+		r.Evidence = append(r.Evidence, evidence(last, "CN2终点"))
+	}
+	var before, inside, after []int
+	for i, e := range entries {
+		if e.asn != "AS4134" {
+			continue
+		}
+		switch {
+		case i < first:
+			before = append(before, i)
+		case i > last:
+			after = append(after, i)
+		default:
+			inside = append(inside, i)
+		}
+	}
+	switch {
+	case len(after) > 0:
+		r.Type, r.Confidence = CN2GT, 0.9
+		r.Evidence = append(r.Evidence, evidence(after[0], "CN2之后的163"))
+	case len(inside) > 0:
+		r.Type, r.Confidence = CN2GT, 0.75
+		r.Evidence = append(r.Evidence, evidence(inside[0], "CN2之间的163"))
+	case len(before) > 0:
+		r.Type, r.Confidence = CN2GT, 0.6
+		r.Evidence = append(r.Evidence, evidence(before[len(before)-1], "CN2之前的163"))
+	default:
+		r.Type, r.Confidence = CN2GIA, 0.6
+		// 59.43 段有多个节点时更可信，若一直延续到最后一个骨干网节点则进一步提高
+		if entries[last].distance > entries[first].distance {
+			r.Confidence = 0.75
+			tail := true
+			for _, e := range entries[last+1:] {
+				if e.asn != "" {
+					tail = false
+				}
+			}
+			if tail {
+				r.Confidence = 0.9
+			}
+		}
+	}
+	return r
+}
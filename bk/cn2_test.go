@@ -0,0 +1,36 @@
+package backtrace
+
+import "testing"
+
+func TestClassifyCN2(t *testing.T) {
+	cases := []struct {
+		name       string
+		hops       []*Hop
+		typ        string
+		confidence float64
+		evidence   string
+	}{
+		{"163 after cn2", testHops("59.43.1.1", 30, "59.43.2.1", 31, "202.97.1.1", 32), CN2GT, 0.9, "202.97.1.1"},
+		{"163 inside cn2", testHops("59.43.1.1", 30, "202.97.1.1", 31, "59.43.2.1", 32), CN2GT, 0.75, "202.97.1.1"},
+		{"163 before cn2", testHops("202.97.1.1", 30, "59.43.1.1", 31, "59.43.2.1", 32), CN2GT, 0.6, "202.97.1.1"},
+		{"cn2 to the edge", testHops("10.0.0.1", 1, "59.43.1.1", 30, "59.43.2.1", 31), CN2GIA, 0.9, "59.43.2.1"},
+		{"single cn2 hop", testHops("10.0.0.1", 1, "59.43.1.1", 30), CN2GIA, 0.6, "59.43.1.1"},
+	}
+	for _, c := range cases {
+		r := classifyCN2(c.hops, currentRules())
+		if r == nil || r.Type != c.typ || r.Confidence != c.confidence {
+			t.Errorf("%s: got %+v; want %s with confidence %v", c.name, r, c.typ, c.confidence)
+			continue
+		}
+		found := false
+		for _, e := range r.Evidence {
+			found = found || e.IP.String() == c.evidence
+		}
+		if !found {
+			t.Errorf("%s: evidence %+v misses %s", c.name, r.Evidence, c.evidence)
+		}
+	}
+	if r := classifyCN2(testHops("202.97.1.1", 30), currentRules()); r != nil {
+		t.Errorf("got %+v without cn2 hops", r)
+	}
+}
@@ -0,0 +1,296 @@
+package backtrace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCymruTTL 未设置缓存有效期时 Team Cymru 查询结果的缓存时间
+	DefaultCymruTTL = 7 * 24 * time.Hour
+
+	cymruTimeout     = 3 * time.Second
+	cymruConcurrency = 16
+	// cymruMaxFailures 连续查询失败的次数达到该值后本次运行不再查询，避免DNS不通时每个跳点都等待超时
+	cymruMaxFailures = 3
+)
+
+var errCymruUnavailable = errors.New("cymru lookups disabled after repeated failures")
+
+// CymruSource 通过DNS查询 Team Cymru 的 origin.asn.cymru.com TXT 记录获取ASN信息
+// 查询结果缓存在内存中，设置了缓存文件时在 Prefetch 和 Close 后写入磁盘，下次启动时读取
+// 查询失败的地址在本次运行中不再查询，连续失败 cymruMaxFailures 次后不再发出任何查询
+type CymruSource struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+	path     string
+
+	mu       sync.Mutex
+	cache    map[string]cymruEntry
+	dirty    bool
+	failed   map[string]error // 查询失败的地址或ASN，不写入缓存文件
+	failures int              // 连续失败的次数
+}
+
+// cymruEntry 缓存的查询结果，Info 为 nil 表示没有记录
+type cymruEntry struct {
+	Info    *ASNInfo  `json:"info,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewCymruSource 创建 Team Cymru 数据源
+// server 为DNS服务器地址，如 1.1.1.1 或 1.1.1.1:53，为空时使用系统的DNS设置
+// cachePath 为缓存文件路径，为空时只缓存在内存中，ttl 为0时使用 DefaultCymruTTL
+func NewCymruSource(server, cachePath string, ttl time.Duration) (*CymruSource, error) {
+	if ttl <= 0 {
+		ttl = DefaultCymruTTL
+	}
+	s := &CymruSource{
+		resolver: net.DefaultResolver,
+		ttl:      ttl,
+		path:     cachePath,
+		cache:    make(map[string]cymruEntry),
+		failed:   make(map[string]error),
+	}
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		s.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	if cachePath != "" {
+		data, err := os.ReadFile(cachePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		// 缓存文件损坏时忽略，查询后会被覆盖
+		if err == nil && json.Unmarshal(data, &s.cache) != nil {
+			s.cache = make(map[string]cymruEntry)
+		}
+	}
+	return s, nil
+}
+
+// DefaultCymruCache 返回默认的缓存文件路径，位于用户缓存目录下
+func DefaultCymruCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "backtrace", "cymru.json")
+}
+
+// Lookup 实现 ASNSource
+func (s *CymruSource) Lookup(ip net.IP) (*ASNInfo, error) {
+	if ip == nil || !isPublicIP(ip) {
+		return nil, nil
+	}
+	key := ip.String()
+	if info, ok := s.cached(key); ok {
+		return info, nil
+	}
+	if err := s.failure(key); err != nil {
+		return nil, err
+	}
+	info, err := s.query(cymruName(ip))
+	if err != nil {
+		s.fail(key, err)
+		return nil, err
+	}
+	if info != nil {
+		info.Org = s.org(info.ASN)
+	}
+	s.store(key, info)
+	return info, nil
+}
+
+// Prefetch 并发查询一批地址并写入缓存文件
+func (s *CymruSource) Prefetch(ips []net.IP) {
+	ch := make(chan net.IP)
+	var wg sync.WaitGroup
+	for i := 0; i < cymruConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range ch {
+				s.Lookup(ip)
+			}
+		}()
+	}
+	for _, ip := range ips {
+		ch <- ip
+	}
+	close(ch)
+	wg.Wait()
+	s.save()
+}
+
+// Close 实现 ASNSource，将缓存写入磁盘
+func (s *CymruSource) Close() error {
+	return s.save()
+}
+
+// org 查询ASN的组织名称，失败时返回空
+func (s *CymruSource) org(asn string) string {
+	if info, ok := s.cached(asn); ok {
+		if info == nil {
+			return ""
+		}
+		return info.Org
+	}
+	if s.failure(asn) != nil {
+		return ""
+	}
+	info, err := s.query(asn + ".asn.cymru.com.")
+	if err != nil {
+		s.fail(asn, err)
+		return ""
+	}
+	s.store(asn, info)
+	if info == nil {
+		return ""
+	}
+	return info.Org
+}
+
+// query 查询TXT记录，记录不存在时返回 nil, nil
+// 地址记录格式为 ASN | 地址段 | 国家 | RIR | 分配日期
+// ASN记录格式为 ASN | 国家 | RIR | 分配日期 | 组织名称
+func (s *CymruSource) query(name string) (*ASNInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cymruTimeout)
+	defer cancel()
+	txts, err := s.resolver.LookupTXT(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, txt := range txts {
+		fields := strings.Split(txt, "|")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		// 同一地址段属于多个ASN时以空格分隔，取第一个
+		asn := strings.Fields(fields[0])
+		if len(asn) == 0 || len(fields) < 5 {
+			continue
+		}
+		info := &ASNInfo{ASN: "AS" + asn[0]}
+		if strings.HasSuffix(name, ".asn.cymru.com.") && strings.HasPrefix(name, "AS") {
+			info.Country, info.Org = fields[1], fields[4]
+		} else {
+			info.Prefix, info.Country = fields[1], fields[2]
+		}
+		return info, nil
+	}
+	return nil, fmt.Errorf("unexpected cymru answer for %s: %q", name, txts)
+}
+
+func (s *CymruSource) cached(key string) (*ASNInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.cache[key]
+	if !ok || time.Now().After(e.Expires) {
+		return nil, false
+	}
+	if e.Info == nil {
+		return nil, true
+	}
+	info := *e.Info
+	return &info, true
+}
+
+func (s *CymruSource) store(key string, info *ASNInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := cymruEntry{Expires: time.Now().Add(s.ttl)}
+	if info != nil {
+		c := *info
+		e.Info = &c
+	}
+	s.cache[key] = e
+	s.dirty = true
+	s.failures = 0
+}
+
+// failure 返回本次运行中该地址或ASN之前的查询错误，连续失败过多时返回 errCymruUnavailable
+func (s *CymruSource) failure(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures >= cymruMaxFailures {
+		return errCymruUnavailable
+	}
+	return s.failed[key]
+}
+
+func (s *CymruSource) fail(key string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed[key] = err
+	s.failures++
+}
+
+// save 将未过期的缓存写入磁盘，先写临时文件再重命名，避免中断时损坏缓存文件
+func (s *CymruSource) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+	now := time.Now()
+	for k, e := range s.cache {
+		if now.After(e.Expires) {
+			delete(s.cache, k)
+		}
+	}
+	data, err := json.Marshal(s.cache)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// cymruName 返回地址对应的查询域名，IPV4按字节倒序，IPV6按半字节倒序
+func cymruName(ip net.IP) string {
+	var sb strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := 3; i >= 0; i-- {
+			fmt.Fprintf(&sb, "%d.", ip4[i])
+		}
+		sb.WriteString("origin.asn.cymru.com.")
+		return sb.String()
+	}
+	ip16 := ip.To16()
+	for i := 15; i >= 0; i-- {
+		fmt.Fprintf(&sb, "%x.%x.", ip16[i]&0xf, ip16[i]>>4)
+	}
+	sb.WriteString("origin6.asn.cymru.com.")
+	return sb.String()
+}
@@ -0,0 +1,166 @@
+package backtrace
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubDNS 在本地启动只回答TXT查询的DNS服务器，records 之外的域名返回 NXDOMAIN
+func stubDNS(t *testing.T, records map[string]string) (string, *int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var queries int32
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			atomic.AddInt32(&queries, 1)
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true})
+			b.EnableCompression()
+			b.StartQuestions()
+			b.Question(q)
+			txt, ok := records[strings.ToLower(q.Name.String())]
+			if ok && q.Type == dnsmessage.TypeTXT {
+				b.StartAnswers()
+				b.TXTResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+					dnsmessage.TXTResource{TXT: []string{txt}})
+			} else if !ok {
+				b = dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true, RCode: dnsmessage.RCodeNameError})
+				b.StartQuestions()
+				b.Question(q)
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &queries
+}
+
+func TestCymruName(t *testing.T) {
+	cases := map[string]string{
+		"202.97.1.2":  "2.1.97.202.origin.asn.cymru.com.",
+		"240e::1":     "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.0.4.2.origin6.asn.cymru.com.",
+		"8.8.8.8":     "8.8.8.8.origin.asn.cymru.com.",
+		"1.2.3.4":     "4.3.2.1.origin.asn.cymru.com.",
+		"2001:db8::f": "f.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.origin6.asn.cymru.com.",
+	}
+	for ip, want := range cases {
+		if got := cymruName(net.ParseIP(ip)); got != want {
+			t.Errorf("cymruName(%s) = %s, want %s", ip, got, want)
+		}
+	}
+}
+
+func TestCymruSource(t *testing.T) {
+	server, queries := stubDNS(t, map[string]string{
+		"4.3.2.1.origin.asn.cymru.com.": "13335 | 1.2.3.0/24 | AU | apnic | 2011-08-11",
+		"8.8.8.8.origin.asn.cymru.com.": "15169 64512 | 8.8.8.0/24 | US | arin | 1992-12-01",
+		"as13335.asn.cymru.com.":        "13335 | US | arin | 2010-07-14 | CLOUDFLARENET, US",
+	})
+	cache := filepath.Join(t.TempDir(), "cymru.json")
+	s, err := NewCymruSource(server, cache, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("8.8.8.8"), net.ParseIP("9.9.9.9"), net.ParseIP("10.0.0.1")}
+	s.Prefetch(ips)
+	// 4 个地址中内网地址不查询，另外 2 次为组织名称查询
+	if n := atomic.LoadInt32(queries); n != 5 {
+		t.Errorf("queries = %d, want 5", n)
+	}
+
+	info, err := s.Lookup(net.ParseIP("1.2.3.4"))
+	if err != nil || info == nil {
+		t.Fatalf("Lookup(1.2.3.4) = %v, %v", info, err)
+	}
+	want := ASNInfo{ASN: "AS13335", Org: "CLOUDFLARENET, US", Country: "AU", Prefix: "1.2.3.0/24"}
+	if *info != want {
+		t.Errorf("Lookup(1.2.3.4) = %+v, want %+v", *info, want)
+	}
+	if info, _ := s.Lookup(net.ParseIP("8.8.8.8")); info == nil || info.ASN != "AS15169" || info.Org != "" {
+		t.Errorf("Lookup(8.8.8.8) = %+v, want AS15169 without org", info)
+	}
+	if info, err := s.Lookup(net.ParseIP("9.9.9.9")); info != nil || err != nil {
+		t.Errorf("Lookup(9.9.9.9) = %+v, %v, want nil", info, err)
+	}
+	if n := atomic.LoadInt32(queries); n != 5 {
+		t.Errorf("queries after cached lookups = %d, want 5", n)
+	}
+
+	// 重新打开时从缓存文件读取，不再发出查询
+	s2, err := NewCymruSource(server, cache, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := s2.Lookup(net.ParseIP("1.2.3.4")); info == nil || *info != want {
+		t.Errorf("cached Lookup(1.2.3.4) = %+v, want %+v", info, want)
+	}
+	if n := atomic.LoadInt32(queries); n != 5 {
+		t.Errorf("queries after reopen = %d, want 5", n)
+	}
+
+	// 缓存过期后重新查询
+	s3, err := NewCymruSource(server, cache, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, e := range s3.cache {
+		e.Expires = time.Now().Add(-time.Minute)
+		s3.cache[k] = e
+	}
+	s3.Lookup(net.ParseIP("9.9.9.9"))
+	if n := atomic.LoadInt32(queries); n != 6 {
+		t.Errorf("queries after expiry = %d, want 6", n)
+	}
+}
+
+func TestCymruSourceFailures(t *testing.T) {
+	// 关闭的端口上DNS查询立即失败
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := conn.LocalAddr().String()
+	conn.Close()
+	s, err := NewCymruSource(server, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Lookup(net.ParseIP("1.2.3.4")); err == nil || err == errCymruUnavailable {
+		t.Fatalf("Lookup(1.2.3.4) = %v, want the query error", err)
+	}
+	s.Prefetch([]net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("5.6.7.8"), net.ParseIP("8.8.8.8"), net.ParseIP("9.9.9.9")})
+	// 连续失败后不再查询，直接返回错误
+	start := time.Now()
+	if _, err := s.Lookup(net.ParseIP("1.1.1.1")); err != errCymruUnavailable {
+		t.Errorf("Lookup(1.1.1.1) = %v, want %v", err, errCymruUnavailable)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Lookup after repeated failures took %v", d)
+	}
+}
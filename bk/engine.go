@@ -0,0 +1,91 @@
+package backtrace
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	. "github.com/oneclickvirt/defaultset"
+)
+
+// Engine 路由追踪引擎，返回按距离排序的有应答的跳点，超时时返回已追踪到的部分及 ctx.Err()
+// onHop 不为 nil 时按距离顺序实时回调每一跳，没有应答的跳点回调时没有节点
+type Engine interface {
+	Name() string
+	Trace(ctx context.Context, ip net.IP, onHop func(hop *Hop)) ([]*Hop, error)
+}
+
+// DefaultEngine 未设置 Options.Engine 时使用的引擎，默认为本地路由追踪
+// NextTrace 出错时可能直接退出进程，因此只由命令行设置为 FallbackEngine{NTraceEngine{}, LocalEngine{}}
+var DefaultEngine Engine = LocalEngine{}
+
+// LocalEngine 使用 DefaultTracer 进行本地路由追踪
+type LocalEngine struct{}
+
+// Name 实现 Engine
+func (LocalEngine) Name() string { return "local" }
+
+// Trace 实现 Engine
+func (LocalEngine) Trace(ctx context.Context, ip net.IP, onHop func(hop *Hop)) ([]*Hop, error) {
+	return TraceContextFunc(ctx, ip, onHop)
+}
+
+// FallbackEngine 依次使用各引擎，前一个引擎出错或没有收到任何应答时使用下一个
+// 除最后一个引擎外，收到第一个应答之前的空跳点暂缓回调，避免换用下一个引擎时重复输出
+type FallbackEngine []Engine
+
+// Name 实现 Engine
+func (f FallbackEngine) Name() string {
+	name := ""
+	for i, e := range f {
+		if i > 0 {
+			name += ","
+		}
+		name += e.Name()
+	}
+	return name
+}
+
+// Trace 实现 Engine
+func (f FallbackEngine) Trace(ctx context.Context, ip net.IP, onHop func(hop *Hop)) ([]*Hop, error) {
+	var (
+		hops []*Hop
+		err  error
+	)
+	for i, e := range f {
+		last := i == len(f)-1
+		hook := onHop
+		var pending []*Hop
+		if onHop != nil && !last {
+			replied := false
+			hook = func(hop *Hop) {
+				if !replied && len(hop.Nodes) == 0 {
+					pending = append(pending, hop)
+					return
+				}
+				replied = true
+				for _, h := range pending {
+					onHop(h)
+				}
+				pending = nil
+				onHop(hop)
+			}
+		}
+		hops, err = e.Trace(ctx, ip, hook)
+		if last || ctx.Err() != nil || err == nil && len(hops) > 0 {
+			for _, h := range pending {
+				onHop(h)
+			}
+			return hops, err
+		}
+		if EnableLoger {
+			InitLogger()
+			defer Logger.Sync()
+			if err == nil {
+				err = fmt.Errorf("no replies")
+			}
+			Logger.Info(fmt.Sprintf("%s trace to %s failed, falling back: %v", e.Name(), ip, err))
+		}
+	}
+	return hops, err
+}
@@ -0,0 +1,116 @@
+package backtrace
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nxtrace/NTrace-core/ipgeo"
+	"github.com/nxtrace/NTrace-core/trace"
+)
+
+// stubEngine 回调并返回固定跳点的引擎
+type stubEngine struct {
+	hops  []*Hop
+	err   error
+	calls int
+}
+
+func (e *stubEngine) Name() string { return "stub" }
+
+func (e *stubEngine) Trace(ctx context.Context, ip net.IP, onHop func(hop *Hop)) ([]*Hop, error) {
+	e.calls++
+	var replied []*Hop
+	for _, h := range e.hops {
+		if onHop != nil {
+			onHop(h)
+		}
+		if len(h.Nodes) > 0 {
+			replied = append(replied, h)
+		}
+	}
+	return replied, e.err
+}
+
+func TestFallbackEngine(t *testing.T) {
+	ok := &stubEngine{hops: testHops("202.97.1.1", 10)}
+	silent := &stubEngine{hops: []*Hop{{Distance: 2}, {Distance: 3}}}
+	broken := &stubEngine{err: errors.New("no raw socket")}
+	var streamed int
+	onHop := func(*Hop) { streamed++ }
+
+	hops, err := FallbackEngine{broken, silent, ok}.Trace(context.Background(), net.ParseIP("192.0.2.1"), onHop)
+	if err != nil || len(hops) != 1 || broken.calls != 1 || silent.calls != 1 || ok.calls != 1 {
+		t.Fatalf("got %v, %v after %d/%d/%d calls", hops, err, broken.calls, silent.calls, ok.calls)
+	}
+	// 换用下一个引擎前没有应答的空跳点不回调
+	if streamed != 1 {
+		t.Errorf("streamed %d hops; want 1", streamed)
+	}
+
+	ok.calls = 0
+	FallbackEngine{ok, broken}.Trace(context.Background(), net.ParseIP("192.0.2.1"), nil)
+	if ok.calls != 1 || broken.calls != 1 {
+		t.Errorf("fell back after a successful trace")
+	}
+	if _, err := (FallbackEngine{silent, broken}).Trace(context.Background(), net.ParseIP("192.0.2.1"), nil); err == nil {
+		t.Error("error of the last engine not returned")
+	}
+}
+
+func TestNTraceEngineTransport(t *testing.T) {
+	route := simRoute("192.0.2.10", "10.0.0.1", "202.97.1.1")
+	withSimTracer(t, route)
+	if _, err := (NTraceEngine{}).Trace(context.Background(), net.ParseIP(route.Dst), nil); err == nil {
+		t.Error("nexttrace used a custom transport")
+	}
+	hops, err := (FallbackEngine{NTraceEngine{}, LocalEngine{}}).Trace(context.Background(), net.ParseIP(route.Dst), nil)
+	if err != nil || len(hops) != 2 {
+		t.Errorf("did not fall back to the local tracer: %v, %v", hops, err)
+	}
+}
+
+func TestNTraceGeoSource(t *testing.T) {
+	for _, name := range []string{"IP.SB", "LeoMoeAPI", "DN42", "unknown"} {
+		if _, err := ntraceGeoSource(name); err == nil {
+			t.Errorf("ntraceGeoSource(%s) accepted", name)
+		}
+	}
+	src, err := ntraceGeoSource("disable-geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo, err := src("192.0.2.1", time.Second, "cn", false); err != nil || geo == nil {
+		t.Errorf("disable-geoip = %+v, %v", geo, err)
+	}
+}
+
+func TestNTraceHop(t *testing.T) {
+	res := &trace.Result{Hops: [][]trace.Hop{
+		nil,
+		{
+			{Success: true, Address: &net.IPAddr{IP: net.ParseIP("203.0.113.1")}, TTL: 2, RTT: 3 * time.Millisecond,
+				Geo: &ipgeo.IPGeoData{Asnumber: "64500", Owner: "Example Net", Country: "中国"}},
+			{Success: true, Address: &net.IPAddr{IP: net.ParseIP("203.0.113.1")}, TTL: 2, RTT: 5 * time.Millisecond},
+			{Success: true, Address: &net.TCPAddr{IP: net.ParseIP("203.0.113.2")}, TTL: 2, RTT: 4 * time.Millisecond},
+			{Success: false, TTL: 2, Error: trace.ErrHopLimitTimeout},
+		},
+	}}
+	t.Cleanup(func() { ntraceASNs.Delete("203.0.113.1") })
+	hop := ntraceHop(res, 2)
+	if hop.Distance != 2 || len(hop.Nodes) != 2 || len(hop.Nodes[0].RTT) != 2 || !hop.Nodes[1].IP.Equal(net.ParseIP("203.0.113.2")) {
+		t.Errorf("got hop %+v", hop)
+	}
+	if h := ntraceHop(res, 3); len(h.Nodes) != 0 {
+		t.Errorf("got nodes beyond the result: %+v", h)
+	}
+	info, _ := getASNInfo("203.0.113.1")
+	if info == nil || info.ASN != "AS64500" || info.Org != "Example Net" {
+		t.Errorf("getASNInfo(203.0.113.1) = %+v", info)
+	}
+	if info, _ := getASNInfo("203.0.113.2"); info != nil {
+		t.Errorf("getASNInfo(203.0.113.2) = %+v; want nil", info)
+	}
+}
@@ -1,10 +1,15 @@
 package backtrace
 
 import (
+	"encoding/binary"
 	"net"
+	"os"
 	"syscall"
+	"time"
 
 	. "github.com/oneclickvirt/defaultset"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 func (t *Tracer) listen(network string, laddr *net.IPAddr) (*net.IPConn, error) {
@@ -51,3 +56,154 @@ func (t *Tracer) listen(network string, laddr *net.IPAddr) (*net.IPConn, error)
 		return conn, nil
 	}
 }
+
+func (t *Tracer) listen6(network string, laddr *net.IPAddr) (*ipv6.PacketConn, error) {
+	var f ipv6.ICMPFilter
+	f.SetAll(true)
+	f.Accept(ipv6.ICMPTypeEchoReply)
+	f.Accept(ipv6.ICMPTypeTimeExceeded)
+	f.Accept(ipv6.ICMPTypeDestinationUnreachable)
+	f.Accept(ipv6.ICMPTypeParameterProblem)
+	if EnableLoger {
+		InitLogger()
+		defer Logger.Sync()
+		conn, err := net.ListenIP(network, laddr)
+		if err != nil {
+			Logger.Info(err.Error())
+			return nil, err
+		}
+		p := ipv6.NewPacketConn(conn)
+		err = p.SetICMPFilter(&f)
+		if err != nil {
+			Logger.Info(err.Error())
+			p.Close()
+			return nil, err
+		}
+		return p, nil
+	} else {
+		conn, err := net.ListenIP(network, laddr)
+		if err != nil {
+			return nil, err
+		}
+		p := ipv6.NewPacketConn(conn)
+		err = p.SetICMPFilter(&f)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		return p, nil
+	}
+}
+
+// listenDgram opens an unprivileged ICMP datagram socket, which needs the
+// group of the process in net.ipv4.ping_group_range. IP_RECVERR queues the
+// ICMP errors caused by our probes, see serveDgram.
+func (t *Tracer) listenDgram(laddr *net.IPAddr) (*net.UDPConn, error) {
+	if EnableLoger {
+		InitLogger()
+		defer Logger.Sync()
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_ICMP)
+	if err != nil {
+		if EnableLoger {
+			Logger.Info(err.Error())
+		}
+		return nil, os.NewSyscallError("socket", err)
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVERR, 1)
+	if err == nil && laddr != nil && laddr.IP.To4() != nil {
+		sa := &syscall.SockaddrInet4{}
+		copy(sa.Addr[:], laddr.IP.To4())
+		err = syscall.Bind(fd, sa)
+	}
+	if err != nil {
+		if EnableLoger {
+			Logger.Info(err.Error())
+		}
+		return nil, err
+	}
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		if EnableLoger {
+			Logger.Info(err.Error())
+		}
+		return nil, err
+	}
+	c, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, errUnsupportedProtocol
+	}
+	return c, nil
+}
+
+// serveDgram reads echo replies and the error queue of an ICMP datagram socket.
+// Queued errors hold the offending router and our original echo request.
+func (t *Tracer) serveDgram(conn *net.UDPConn) error {
+	defer conn.Close()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	oob := make([]byte, 512)
+	for {
+		var (
+			n, oobn int
+			from    syscall.Sockaddr
+			errq    bool
+			rerr    error
+		)
+		err = raw.Read(func(fd uintptr) bool {
+			n, oobn, _, from, rerr = syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if rerr == nil {
+				errq = true
+				return true
+			}
+			n, _, _, from, rerr = syscall.Recvmsg(int(fd), buf, nil, syscall.MSG_DONTWAIT)
+			return rerr != syscall.EAGAIN
+		})
+		if err != nil {
+			return err
+		}
+		sa, ok := from.(*syscall.SockaddrInet4)
+		if rerr != nil || !ok || n < 8 {
+			continue
+		}
+		now := time.Now()
+		id := binary.BigEndian.Uint16(buf[6:8])
+		dst := net.IP(sa.Addr[:]).To4()
+		if !errq {
+			if ipv4.ICMPType(buf[0]) == ipv4.ICMPTypeEchoReply {
+				t.serveReply(dst, &packet{dst, id, 1, now})
+			}
+			continue
+		}
+		if offender := dgramOffender(oob[:oobn]); offender != nil {
+			t.serveReply(dst, &packet{offender, id, 1, now})
+		}
+	}
+}
+
+// dgramOffender returns the address of the router which sent the ICMP error
+// described by the IP_RECVERR control message in oob.
+func dgramOffender(oob []byte) net.IP {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.IPPROTO_IP || m.Header.Type != syscall.IP_RECVERR {
+			continue
+		}
+		// struct sock_extended_err followed by the offender sockaddr_in
+		const eeLen, originICMP = 16, 2
+		if len(m.Data) < eeLen+8 || m.Data[4] != originICMP {
+			continue
+		}
+		return net.IPv4(m.Data[eeLen+4], m.Data[eeLen+5], m.Data[eeLen+6], m.Data[eeLen+7]).To4()
+	}
+	return nil
+}
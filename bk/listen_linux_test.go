@@ -0,0 +1,103 @@
+package backtrace
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// recvErr 构造一条 IP_RECVERR 控制消息，data 为 sock_extended_err 及其后的 sockaddr_in
+func recvErr(origin byte, offender net.IP, dataLen int) []byte {
+	data := make([]byte, dataLen)
+	if len(data) > 4 {
+		data[4] = origin
+	}
+	if len(data) >= 24 {
+		copy(data[20:24], offender.To4())
+	}
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level, h.Type = syscall.IPPROTO_IP, syscall.IP_RECVERR
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func TestDgramOffender(t *testing.T) {
+	router := net.ParseIP("202.97.1.1")
+	full := recvErr(2, router, 32)
+	cases := []struct {
+		name string
+		oob  []byte
+		want net.IP
+	}{
+		{"icmp", full, router},
+		// SO_EE_ORIGIN_LOCAL 为本机产生的错误，没有路由节点
+		{"local", recvErr(1, router, 32), nil},
+		{"short data", recvErr(2, router, 20), nil},
+		{"truncated", full[:10], nil},
+		{"empty", nil, nil},
+	}
+	for _, c := range cases {
+		if got := dgramOffender(c.oob); !got.Equal(c.want) {
+			t.Errorf("%s: got %v; want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// pingAllowed 返回当前进程的组是否在 net.ipv4.ping_group_range 之内
+func pingAllowed() (bool, error) {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/ping_group_range")
+	if err != nil {
+		return false, err
+	}
+	var lo, hi int
+	if _, err := fmt.Sscan(string(b), &lo, &hi); err != nil {
+		return false, err
+	}
+	groups, err := os.Getgroups()
+	if err != nil {
+		return false, err
+	}
+	for _, g := range append(groups, os.Getgid()) {
+		if g >= lo && g <= hi {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestTraceDgram(t *testing.T) {
+	if ok, err := pingAllowed(); !ok {
+		t.Skipf("ICMP datagram sockets not allowed: %v", err)
+	}
+	c := DefaultConfig
+	c.Timeout = time.Second
+	tr := &Tracer{Config: c}
+	tr.once.Do(func() {})
+	conn, err := tr.listenDgram(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.dgram = conn
+	go tr.serveDgram(conn)
+	defer tr.Close()
+	dst := net.ParseIP("127.0.0.1")
+	reached := false
+	err = tr.Trace(context.Background(), dst, func(r *Reply) {
+		if r.IP.Equal(dst) {
+			reached = true
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reached {
+		t.Error("no echo reply from 127.0.0.1 through the datagram socket")
+	}
+}
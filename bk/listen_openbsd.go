@@ -5,6 +5,7 @@ import (
 	"syscall"
 
 	. "github.com/oneclickvirt/defaultset"
+	"golang.org/x/net/ipv6"
 )
 
 func (t *Tracer) listen(network string, laddr *net.IPAddr) (*net.IPConn, error) {
@@ -51,3 +52,51 @@ func (t *Tracer) listen(network string, laddr *net.IPAddr) (*net.IPConn, error)
 		return conn, nil
 	}
 }
+
+func (t *Tracer) listen6(network string, laddr *net.IPAddr) (*ipv6.PacketConn, error) {
+	var f ipv6.ICMPFilter
+	f.SetAll(true)
+	f.Accept(ipv6.ICMPTypeEchoReply)
+	f.Accept(ipv6.ICMPTypeTimeExceeded)
+	f.Accept(ipv6.ICMPTypeDestinationUnreachable)
+	f.Accept(ipv6.ICMPTypeParameterProblem)
+	if EnableLoger {
+		InitLogger()
+		defer Logger.Sync()
+		conn, err := net.ListenIP(network, laddr)
+		if err != nil {
+			Logger.Info(err.Error())
+			return nil, err
+		}
+		p := ipv6.NewPacketConn(conn)
+		err = p.SetICMPFilter(&f)
+		if err != nil {
+			Logger.Info(err.Error())
+			p.Close()
+			return nil, err
+		}
+		return p, nil
+	} else {
+		conn, err := net.ListenIP(network, laddr)
+		if err != nil {
+			return nil, err
+		}
+		p := ipv6.NewPacketConn(conn)
+		err = p.SetICMPFilter(&f)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		return p, nil
+	}
+}
+
+// listenDgram is only implemented on Linux, where ICMP datagram sockets
+// report the ICMP errors needed for tracing through IP_RECVERR.
+func (t *Tracer) listenDgram(laddr *net.IPAddr) (*net.UDPConn, error) {
+	return nil, errUnsupportedProtocol
+}
+
+func (t *Tracer) serveDgram(conn *net.UDPConn) error {
+	return errUnsupportedProtocol
+}
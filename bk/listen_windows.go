@@ -7,6 +7,7 @@ import (
 	"net"
 
 	. "github.com/oneclickvirt/defaultset"
+	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/windows"
 )
 
@@ -54,3 +55,34 @@ func (t *Tracer) listen(network string, laddr *net.IPAddr) (*net.IPConn, error)
 		return conn, nil
 	}
 }
+
+// listen6 opens a raw ICMPv6 socket, Windows does not support ICMPv6 filters
+// so unrelated messages are dropped by serveData6 instead.
+func (t *Tracer) listen6(network string, laddr *net.IPAddr) (*ipv6.PacketConn, error) {
+	if EnableLoger {
+		InitLogger()
+		defer Logger.Sync()
+		conn, err := net.ListenIP(network, laddr)
+		if err != nil {
+			Logger.Info(err.Error())
+			return nil, err
+		}
+		return ipv6.NewPacketConn(conn), nil
+	} else {
+		conn, err := net.ListenIP(network, laddr)
+		if err != nil {
+			return nil, err
+		}
+		return ipv6.NewPacketConn(conn), nil
+	}
+}
+
+// listenDgram is only implemented on Linux, where ICMP datagram sockets
+// report the ICMP errors needed for tracing through IP_RECVERR.
+func (t *Tracer) listenDgram(laddr *net.IPAddr) (*net.UDPConn, error) {
+	return nil, errUnsupportedProtocol
+}
+
+func (t *Tracer) serveDgram(conn *net.UDPConn) error {
+	return errUnsupportedProtocol
+}
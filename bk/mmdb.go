@@ -0,0 +1,58 @@
+package backtrace
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MMDBSource 读取 MaxMind 格式的ASN数据库，支持 GeoLite2-ASN 和 ipinfo 的 ASN 数据库
+type MMDBSource struct {
+	r *maxminddb.Reader
+}
+
+// mmdbRecord 同时包含 GeoLite2-ASN 和 ipinfo 两种数据库的字段，缺少的字段保持零值
+type mmdbRecord struct {
+	Number uint   `maxminddb:"autonomous_system_number"`
+	Org    string `maxminddb:"autonomous_system_organization"`
+
+	ASN     string `maxminddb:"asn"`
+	Name    string `maxminddb:"as_name"`
+	Country string `maxminddb:"country"`
+}
+
+// OpenMMDB 打开 MaxMind 格式的数据库文件
+func OpenMMDB(path string) (*MMDBSource, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MMDBSource{r: r}, nil
+}
+
+// Lookup 实现 ASNSource
+func (s *MMDBSource) Lookup(ip net.IP) (*ASNInfo, error) {
+	var rec mmdbRecord
+	network, ok, err := s.r.LookupNetwork(ip, &rec)
+	if err != nil || !ok {
+		return nil, err
+	}
+	info := &ASNInfo{Org: rec.Org, Country: rec.Country, Prefix: network.String()}
+	switch {
+	case rec.Number != 0:
+		info.ASN = fmt.Sprintf("AS%d", rec.Number)
+	case rec.ASN != "":
+		info.ASN = "AS" + strings.TrimPrefix(strings.ToUpper(rec.ASN), "AS")
+		info.Org = rec.Name
+	default:
+		return nil, nil
+	}
+	return info, nil
+}
+
+// Close 实现 ASNSource
+func (s *MMDBSource) Close() error {
+	return s.r.Close()
+}
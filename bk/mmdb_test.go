@@ -0,0 +1,129 @@
+package backtrace
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// mmdbString 按 MaxMind DB 数据段格式编码长度小于285的字符串
+func mmdbString(s string) []byte {
+	if len(s) < 29 {
+		return append([]byte{0x40 | byte(len(s))}, s...)
+	}
+	return append([]byte{0x40 | 29, byte(len(s) - 29)}, s...)
+}
+
+// mmdbMap 按 MaxMind DB 数据段格式编码只含字符串键的小型 map，值为已编码的数据
+func mmdbMap(kv ...any) []byte {
+	b := []byte{0xe0 | byte(len(kv)/2)}
+	for i := 0; i < len(kv); i += 2 {
+		b = append(b, mmdbString(kv[i].(string))...)
+		b = append(b, kv[i+1].([]byte)...)
+	}
+	return b
+}
+
+// mmdbUint 按 MaxMind DB 数据段格式编码 uint16(typ 5)或 uint32(typ 6)
+func mmdbUint(typ byte, v uint32) []byte {
+	var n []byte
+	for ; v > 0; v >>= 8 {
+		n = append([]byte{byte(v)}, n...)
+	}
+	return append([]byte{typ<<5 | byte(len(n))}, n...)
+}
+
+// writeMMDB 生成 IPV6 的 MaxMind DB 文件，1.2.0.0/16 为 GeoLite2-ASN 格式的记录，2408::/16 为 ipinfo 格式的记录
+func writeMMDB(t *testing.T) string {
+	records := []struct {
+		ip   net.IP
+		bits int
+		data []byte
+	}{
+		{net.ParseIP("::1.2.0.0"), 112, mmdbMap(
+			"autonomous_system_number", mmdbUint(6, 4837),
+			"autonomous_system_organization", mmdbString("CHINA UNICOM China169 Backbone"),
+		)},
+		{net.ParseIP("2408::"), 16, mmdbMap(
+			"asn", mmdbString("AS4837"),
+			"as_name", mmdbString("China Unicom"),
+			"country", mmdbString("CN"),
+		)},
+	}
+	// 搜索树的节点，负数 -1 表示没有数据，-2-i 表示第 i 条记录
+	nodes := [][2]int{{-1, -1}}
+	for i, r := range records {
+		n := 0
+		for bit := 0; bit < r.bits; bit++ {
+			side := int(r.ip[bit/8]>>(7-bit%8)) & 1
+			if bit == r.bits-1 {
+				nodes[n][side] = -2 - i
+				break
+			}
+			if nodes[n][side] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[n][side] = len(nodes) - 1
+			}
+			n = nodes[n][side]
+		}
+	}
+	var data []byte
+	offsets := make([]int, len(records))
+	for i, r := range records {
+		offsets[i] = len(data)
+		data = append(data, r.data...)
+	}
+	var buf []byte
+	for _, node := range nodes {
+		for _, v := range node {
+			switch {
+			case v == -1:
+				v = len(nodes)
+			case v < -1:
+				v = len(nodes) + 16 + offsets[-2-v]
+			}
+			buf = append(buf, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, "\xab\xcd\xefMaxMind.com"...)
+	buf = append(buf, mmdbMap(
+		"node_count", mmdbUint(6, uint32(len(nodes))),
+		"record_size", mmdbUint(5, 24),
+		"ip_version", mmdbUint(5, 6),
+		"database_type", mmdbString("Test-ASN"),
+		"binary_format_major_version", mmdbUint(5, 2),
+		"binary_format_minor_version", mmdbUint(5, 0),
+	)...)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMMDBSource(t *testing.T) {
+	s, err := OpenMMDB(writeMMDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cases := map[string]*ASNInfo{
+		"1.2.3.4":        {ASN: "AS4837", Org: "CHINA UNICOM China169 Backbone", Prefix: "1.2.0.0/16"},
+		"1.3.0.1":        nil,
+		"2408:8000::1":   {ASN: "AS4837", Org: "China Unicom", Country: "CN", Prefix: "2408::/16"},
+		"240e:0:a::c9:1": nil,
+	}
+	for ip, want := range cases {
+		got, err := s.Lookup(net.ParseIP(ip))
+		if err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v; want %+v", ip, got, want)
+		}
+	}
+}
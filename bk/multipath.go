@@ -0,0 +1,206 @@
+package backtrace
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// maxMultipathProbes limits the number of flows probed at a single TTL.
+const maxMultipathProbes = 256
+
+// Multipath is the graph of load balanced paths towards a destination.
+// Each Hop lists all interfaces found at that distance and Links connect
+// interfaces of consecutive hops which were traversed by the same flow.
+// Paths lists the distinct routes taken by the flows probed at every TTL.
+type Multipath struct {
+	Hops  []*Hop
+	Links []*Link
+	Paths []*Path
+}
+
+// Path is a route through the multipath graph. IPs holds one interface per
+// entry of Multipath.Hops, nil where the flows got no reply.
+type Path struct {
+	IPs   []net.IP
+	Flows int
+}
+
+// Link is an edge of the multipath graph.
+type Link struct {
+	Distance int
+	From     net.IP
+	To       net.IP
+	Flows    int
+}
+
+// IsDiamond returns true if more than one interface was found at some hop.
+func (m *Multipath) IsDiamond() bool {
+	for _, h := range m.Hops {
+		if len(h.Nodes) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// TraceMultipath discovers all load balanced paths to ip like the Multipath
+// Detection Algorithm: at every TTL it sends probes with varying flow
+// identifiers until, with Config.Confidence, no further next hop is left.
+// The same flow identifiers are reused at every TTL so that a flow answered
+// at two consecutive TTLs yields a link between both interfaces.
+// When ctx is done the graph discovered so far is returned with ctx.Err().
+func (t *Tracer) TraceMultipath(ctx context.Context, ip net.IP) (*Multipath, error) {
+	sess, err := t.NewSession(ip)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+
+	base := t.nextID()
+	flowID := func(i int) uint16 {
+		// 0 means a new flow per probe for PingFlow
+		f := base + uint16(i)
+		if f == 0 {
+			f = base - uint16(i) - 1
+		}
+		return f
+	}
+	m := &Multipath{}
+	var prev map[uint16]net.IP
+	flows := make(map[uint16][]net.IP)
+	probed := maxMultipathProbes
+	defer func() { m.addPaths(flows, flowID, probed) }()
+	for ttl := 1; ttl <= t.MaxHops; ttl++ {
+		// PingFlow sends at ttl+1, so distances match Trace
+		hop := &Hop{Distance: ttl + 1}
+		cur := make(map[uint16]net.IP)
+		sent := 0
+		for sent < maxMultipathProbes {
+			want := mdaProbes(len(hop.Nodes), t.confidence())
+			if sent >= want {
+				break
+			}
+			if want > maxMultipathProbes {
+				want = maxMultipathProbes
+			}
+			for ; sent < want; sent++ {
+				err = sess.PingFlow(ttl, flowID(sent))
+				if err != nil {
+					return nil, err
+				}
+			}
+			err = t.collect(ctx, sess, want-len(cur), func(r *Reply) {
+				if _, ok := cur[r.Flow]; ok {
+					return
+				}
+				cur[r.Flow] = r.IP
+				hop.Add(r)
+			})
+			if err != nil {
+				if ctx.Err() != nil {
+					return m, err
+				}
+				return nil, err
+			}
+		}
+		if sent < probed {
+			probed = sent
+		}
+		m.Hops = append(m.Hops, hop)
+		m.addLinks(ttl-1, prev, cur)
+		for flow, a := range cur {
+			path := flows[flow]
+			for len(path) < ttl-1 {
+				path = append(path, nil)
+			}
+			flows[flow] = append(path, a)
+		}
+		prev = cur
+		if len(hop.Nodes) == 1 && ip.Equal(hop.Nodes[0].IP) {
+			break
+		}
+	}
+	return m, nil
+}
+
+// collect passes replies to h until n replies arrived or none arrived for Timeout.
+func (t *Tracer) collect(ctx context.Context, sess *Session, n int, h func(r *Reply)) error {
+	deadline := time.NewTimer(t.Timeout)
+	defer deadline.Stop()
+	for ; n > 0; n-- {
+		select {
+		case r := <-sess.Receive():
+			h(r)
+		case <-deadline.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (m *Multipath) addLinks(dist int, from, to map[uint16]net.IP) {
+	for flow, a := range from {
+		b, ok := to[flow]
+		if !ok {
+			continue
+		}
+		var link *Link
+		for _, it := range m.Links {
+			if it.Distance == dist && it.From.Equal(a) && it.To.Equal(b) {
+				link = it
+				break
+			}
+		}
+		if link == nil {
+			link = &Link{Distance: dist, From: a, To: b}
+			m.Links = append(m.Links, link)
+		}
+		link.Flows++
+	}
+}
+
+// addPaths groups the first n flows, which were probed at every TTL, by the
+// interfaces they traversed. Flows without any reply are left out.
+func (m *Multipath) addPaths(flows map[uint16][]net.IP, flowID func(int) uint16, n int) {
+	seen := make(map[string]*Path)
+	for i := 0; i < n; i++ {
+		ips := flows[flowID(i)]
+		if len(ips) == 0 {
+			continue
+		}
+		for len(ips) < len(m.Hops) {
+			ips = append(ips, nil)
+		}
+		key := fmt.Sprint(ips)
+		if p, ok := seen[key]; ok {
+			p.Flows++
+			continue
+		}
+		p := &Path{IPs: ips, Flows: 1}
+		seen[key] = p
+		m.Paths = append(m.Paths, p)
+	}
+}
+
+func (t *Tracer) confidence() float64 {
+	if t.Confidence <= 0 || t.Confidence >= 1 {
+		return 0.95
+	}
+	return t.Confidence
+}
+
+// mdaProbes returns the number of probes needed to rule out, with the given
+// confidence, that a hop where k interfaces were found has k+1 of them.
+func mdaProbes(k int, confidence float64) int {
+	if k < 1 {
+		k = 1
+	}
+	alpha := 1 - confidence
+	n := math.Log(alpha/float64(k+1)) / math.Log(float64(k)/float64(k+1))
+	return int(math.Ceil(n))
+}
@@ -0,0 +1,15 @@
+package backtrace
+
+import (
+	"testing"
+)
+
+func TestMdaProbes(t *testing.T) {
+	// 95% 置信度下 MDA 论文给出的前几个停止点
+	want := []int{6, 11, 16, 21, 27}
+	for k, n := range want {
+		if got := mdaProbes(k+1, 0.95); got != n {
+			t.Errorf("mdaProbes(%d) = %d; want %d", k+1, got, n)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package backtrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nxtrace/NTrace-core/ipgeo"
+	"github.com/nxtrace/NTrace-core/trace"
+)
+
+// DefaultGeoSource NextTrace 查询跳点IP信息默认使用的数据源，为空时不查询
+// 在线数据源会将每个跳点的IP发送给第三方接口，需要时显式指定
+const DefaultGeoSource = ""
+
+// ntracePktSize NextTrace 探测包的负载大小，与 nexttrace 命令行的默认值一致
+const ntracePktSize = 52
+
+// NTraceEngine 使用 NextTrace 进行路由追踪，探测方式、端口、跳数和超时沿用 DefaultTracer 的设置，不支持 Paris
+// GeoSource 不为空时由 NextTrace 查询各跳点的IP信息，查到的ASN只用于展示，不参与线路判断
+// NextTrace 不支持取消，ctx 结束后不再回调，等待 NextTrace 在自身超时后结束再返回已追踪到的跳点，避免与后续的追踪同时探测
+// 注意 NextTrace 发送探测包失败时会调用 log.Fatal 直接退出进程，这里只预先检查了到目标的路由，不能退出进程的调用方应使用 LocalEngine
+type NTraceEngine struct {
+	GeoSource string // NextTrace 的IP信息数据源，如 IPInfo、IP-API.com，为空时不查询，不支持的数据源见 ntraceGeoSource
+}
+
+// ntraceASNs NextTrace 查询到的跳点ASN信息，按地址缓存
+var ntraceASNs sync.Map
+
+// Name 实现 Engine
+func (NTraceEngine) Name() string { return "nexttrace" }
+
+// Trace 实现 Engine
+func (e NTraceEngine) Trace(ctx context.Context, ip net.IP, onHop func(hop *Hop)) ([]*Hop, error) {
+	t := DefaultTracer
+	if t.Transport != nil {
+		return nil, errors.New("nexttrace does not support custom transports")
+	}
+	// 没有到目标的路由时 NextTrace 发送失败会直接退出进程，因此先确认路由并取得源地址
+	conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), "80"))
+	if err != nil {
+		return nil, err
+	}
+	src := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	method := trace.Method(t.Probe)
+	if method == "" {
+		method = trace.ICMPTrace
+	}
+	count := t.Count
+	if count <= 0 {
+		count = 1
+	}
+	config := trace.Config{
+		SrcAddr:         src.String(),
+		BeginHop:        2, // 与本地路由追踪一致，不探测第一跳的网关
+		MaxHops:         t.MaxHops,
+		NumMeasurements: count,
+		Timeout:         t.Timeout,
+		DestIP:          ip,
+		DestPort:        t.port(),
+		TTLInterval:     int(t.Delay / time.Millisecond),
+		PktSize:         ntracePktSize,
+		Lang:            "cn",
+	}
+	if e.GeoSource != "" {
+		if config.IPGeoSource, err = ntraceGeoSource(e.GeoSource); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		hops    []*Hop // 已回调的有应答的跳点，ctx 结束时返回
+		next    = config.BeginHop
+		reached bool
+		stopped bool
+	)
+	// emit 按距离顺序回调 upto 及之前的跳点，NextTrace 会对最后一跳重复回调
+	emit := func(res *trace.Result, upto int) {
+		for ; !reached && next <= upto && next <= t.MaxHops; next++ {
+			hop := ntraceHop(res, next)
+			if len(hop.Nodes) > 0 {
+				hops = append(hops, hop)
+			}
+			if onHop != nil {
+				onHop(hop)
+			}
+			reached = len(hop.Nodes) == 1 && ip.Equal(hop.Nodes[0].IP)
+		}
+	}
+	config.RealtimePrinter = func(res *trace.Result, ttl int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped {
+			emit(res, ttl+1)
+		}
+	}
+
+	type outcome struct {
+		res *trace.Result
+		err error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		res, err := trace.Traceroute(method, config)
+		done <- outcome{res, err}
+	}()
+	select {
+	case o := <-done:
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		if o.err != nil {
+			return nil, o.err
+		}
+		if n := len(o.res.Hops); n > 0 {
+			emit(o.res, n)
+		}
+		return hops, nil
+	case <-ctx.Done():
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		<-done
+		return hops, ctx.Err()
+	}
+}
+
+// CheckGeoSource 检查 NTraceEngine 是否支持该IP信息数据源
+func CheckGeoSource(name string) error {
+	_, err := ntraceGeoSource(name)
+	return err
+}
+
+// ntraceGeoSource 返回 NextTrace 的IP信息数据源
+// IP.SB 被风控时 NextTrace 会直接退出进程，LeoMoeAPI 需要 NextTrace 命令行建立的连接，DN42 需要 NextTrace 的配置文件，均不支持
+// 本地数据库缺失时 NextTrace 会 panic，这里转换为查询失败
+func ntraceGeoSource(name string) (ipgeo.Source, error) {
+	switch strings.ToUpper(name) {
+	case "IPINSIGHT", "IPAPI.COM", "IP-API.COM", "IPINFO", "IP2REGION", "IPINFOLOCAL", "CHUNZHEN", "DISABLE-GEOIP":
+	default:
+		return nil, fmt.Errorf("unsupported nexttrace geo source %q", name)
+	}
+	src := ipgeo.GetSource(name)
+	return func(ip string, timeout time.Duration, lang string, maptrace bool) (geo *ipgeo.IPGeoData, err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				geo, err = nil, fmt.Errorf("nexttrace geo source %s: %v", name, v)
+			}
+		}()
+		return src(ip, timeout, lang, maptrace)
+	}, nil
+}
+
+// ntraceHop 将 NextTrace 第 dist 跳的各次探测结果合并为一跳，并缓存查询到的ASN信息
+func ntraceHop(res *trace.Result, dist int) *Hop {
+	hop := &Hop{Distance: dist}
+	if dist > len(res.Hops) {
+		return hop
+	}
+	for _, h := range res.Hops[dist-1] {
+		ip := addrIP(h.Address)
+		if !h.Success || ip == nil {
+			continue
+		}
+		hop.Add(&Reply{IP: ip, RTT: h.RTT, Hops: dist})
+		if info := geoASNInfo(h.Geo); info != nil {
+			ntraceASNs.Store(ip.String(), info)
+		}
+	}
+	return hop
+}
+
+// geoASNInfo 将 NextTrace 的IP信息转换为ASN信息，没有ASN时返回 nil
+func geoASNInfo(geo *ipgeo.IPGeoData) *ASNInfo {
+	if geo == nil || geo.Asnumber == "" {
+		return nil
+	}
+	info := &ASNInfo{
+		ASN:     "AS" + strings.TrimPrefix(strings.ToUpper(geo.Asnumber), "AS"),
+		Org:     geo.Owner,
+		Country: geo.Country,
+		Prefix:  geo.Prefix,
+	}
+	if info.Org == "" {
+		info.Org = geo.Isp
+	}
+	if info.Org == "" {
+		info.Org = geo.Whois
+	}
+	return info
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// ntraceASN 返回 NextTrace 查询到的地址ASN信息，没有时返回 nil
+func ntraceASN(ip net.IP) *ASNInfo {
+	v, ok := ntraceASNs.Load(ip.String())
+	if !ok {
+		return nil
+	}
+	info := *v.(*ASNInfo)
+	return &info
+}
@@ -60,10 +60,10 @@ func RealtimePrinter(hop *Hop, ttl int, config *PrinterConfig) {
 			}
 		}
 
-		asn := ipAsn(ip)
-		if asn != "" {
-			info := ASNInfo{ASN: asn}
-			lineType := getLineType(info)
+		info, _ := getASNInfo(ip)
+		if info != nil && info.ASN != "" {
+			asn := info.ASN
+			lineType := getLineType(*info)
 			if strings.Contains(lineType, "精品线路") {
 				fmt.Fprintf(color.Output, " %s", color.New(color.FgHiYellow, color.Bold).Sprintf("AS%-6s", asn[2:]))
 			} else if strings.Contains(lineType, "优质线路") {
@@ -85,6 +85,9 @@ func RealtimePrinter(hop *Hop, ttl int, config *PrinterConfig) {
 				color.New(color.FgHiCyan, color.Bold).Sprintf("%.2f ms", rtt.Seconds()*1000),
 			)
 		}
+		if info != nil && info.Org != "" {
+			fmt.Fprintf(color.Output, "   %s", color.New(color.FgWhite).Sprint(info.Org))
+		}
 		fmt.Println()
 		blockDisplay = true
 	}
@@ -0,0 +1,204 @@
+package backtrace
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/oneclickvirt/defaultset"
+	"gopkg.in/yaml.v3"
+)
+
+// Rules 线路识别规则，包括骨干网地址段和线路类型
+type Rules struct {
+	Prefixes []Prefix `json:"prefixes" yaml:"prefixes"`
+	Lines    []Line   `json:"lines" yaml:"lines"`
+}
+
+//go:embed rules.yaml
+var defaultRulesData []byte
+
+// colors 规则文件中可用的颜色
+var colors = map[string]func(string) string{
+	"red":       Red,
+	"green":     Green,
+	"darkgreen": DarkGreen,
+	"yellow":    Yellow,
+	"blue":      Blue,
+	"purple":    Purple,
+	"cyan":      Cyan,
+	"white":     White,
+}
+
+// ruleSet 编译后的规则，创建后只读，可在多个协程中同时使用
+type ruleSet struct {
+	trie  *prefixTrie
+	lines map[string]Line
+}
+
+var (
+	rulesMu sync.RWMutex
+	rules   = mustCompileRules(DefaultRules())
+)
+
+// DefaultRules 返回内置的默认规则，每次调用返回新的副本
+func DefaultRules() *Rules {
+	r, err := ParseRules(defaultRulesData, "yaml")
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// ParseRules 解析 yaml 或 json 格式的规则
+func ParseRules(data []byte, format string) (*Rules, error) {
+	r := &Rules{}
+	var err error
+	switch strings.ToLower(format) {
+	case "json":
+		err = json.Unmarshal(data, r)
+	case "yaml", "yml":
+		err = yaml.Unmarshal(data, r)
+	default:
+		return nil, fmt.Errorf("unsupported rules format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse rules: %v", err)
+	}
+	return r, nil
+}
+
+// LoadRules 读取规则文件，按扩展名区分格式，.json 为 json，其余为 yaml
+func LoadRules(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := "yaml"
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		format = "json"
+	}
+	return ParseRules(data, format)
+}
+
+// SetRules 校验并替换当前使用的规则，正在进行的检测不受影响
+func SetRules(r *Rules) error {
+	rs, err := compileRules(r)
+	if err != nil {
+		return err
+	}
+	rulesMu.Lock()
+	rules = rs
+	rulesMu.Unlock()
+	return nil
+}
+
+func currentRules() *ruleSet {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	return rules
+}
+
+func compileRules(r *Rules) (*ruleSet, error) {
+	if _, err := r.Validate(); err != nil {
+		return nil, err
+	}
+	trie, err := newPrefixTrie(r.Prefixes)
+	if err != nil {
+		return nil, err
+	}
+	rs := &ruleSet{trie: trie, lines: make(map[string]Line, len(r.Lines))}
+	for _, l := range r.Lines {
+		rs.lines[l.ASN] = l
+	}
+	return rs, nil
+}
+
+func mustCompileRules(r *Rules) *ruleSet {
+	rs, err := compileRules(r)
+	if err != nil {
+		panic(err)
+	}
+	return rs
+}
+
+// Validate 检查规则，格式错误时返回 error
+// 地址段重复、被包含等不影响使用的问题作为警告返回，范围小的地址段仍然优先匹配
+func (r *Rules) Validate() (warnings []string, err error) {
+	type entry struct {
+		Prefix
+		net  *net.IPNet
+		ones int
+	}
+	var entries []entry
+	for _, p := range r.Prefixes {
+		if p.ASN == "" {
+			return nil, fmt.Errorf("prefix %q has no asn", p.CIDR)
+		}
+		_, ipnet, err := net.ParseCIDR(p.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q: %v", p.CIDR, err)
+		}
+		if ipnet.String() != p.CIDR {
+			warnings = append(warnings, fmt.Sprintf("prefix %s has host bits set, treated as %s", p.CIDR, ipnet))
+		}
+		ones, _ := ipnet.Mask.Size()
+		entries = append(entries, entry{p, ipnet, ones})
+	}
+	seen := make(map[string]bool)
+	for _, l := range r.Lines {
+		if l.ASN == "" || l.Name == "" {
+			return nil, fmt.Errorf("line %+v needs both asn and name", l)
+		}
+		if _, ok := colors[strings.ToLower(l.Color)]; l.Color != "" && !ok {
+			return nil, fmt.Errorf("line %s has unknown color %q", l.ASN, l.Color)
+		}
+		if seen[l.ASN] {
+			warnings = append(warnings, fmt.Sprintf("line %s is defined more than once, the last one is used", l.ASN))
+		}
+		seen[l.ASN] = true
+	}
+	// 按前缀长度从短到长插入，插入前查询到的就是包含当前地址段的最小地址段
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].ones < entries[j].ones })
+	trie := &prefixTrie{root4: &trieNode{}, root6: &trieNode{}}
+	for _, e := range entries {
+		if outer := trie.lookup(e.net.IP); outer != nil {
+			_, outerNet, _ := net.ParseCIDR(outer.CIDR)
+			outerOnes, _ := outerNet.Mask.Size()
+			switch {
+			case outerOnes == e.ones:
+				warnings = append(warnings, fmt.Sprintf("prefix %s (%s) is shadowed by a later duplicate (%s)", outer.CIDR, outer.ASN, e.ASN))
+			case outer.ASN == e.ASN && outer.Tier == e.Tier:
+				warnings = append(warnings, fmt.Sprintf("prefix %s (%s) is redundant, already covered by %s", e.CIDR, e.ASN, outer.CIDR))
+			default:
+				warnings = append(warnings, fmt.Sprintf("prefix %s (%s) overlaps %s (%s) and takes precedence inside it", e.CIDR, e.ASN, outer.CIDR, outer.ASN))
+			}
+		}
+		trie.insert(e.Prefix)
+	}
+	return warnings, nil
+}
+
+// lookup 返回地址所属的骨干网地址段
+func (rs *ruleSet) lookup(ip net.IP) *Prefix {
+	return rs.trie.lookup(ip)
+}
+
+// lookupPrefix 返回地址在当前规则中所属的骨干网地址段
+func lookupPrefix(ip net.IP) *Prefix {
+	return currentRules().lookup(ip)
+}
+
+// lineColor 返回线路在输出时使用的颜色
+func lineColor(l Line) func(string) string {
+	if c, ok := colors[strings.ToLower(l.Color)]; ok {
+		return c
+	}
+	return White
+}
@@ -0,0 +1,85 @@
+package backtrace
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefaultRulesValidate(t *testing.T) {
+	warnings, err := DefaultRules().Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 默认规则中只有 CMIN2 地址段位于 CMI 地址段之内，黑龙江联通位于 163 地址段之内
+	for _, w := range warnings {
+		if !strings.Contains(w, "(AS58807) overlaps 223.120.0.0/15 (AS58453)") &&
+			!strings.Contains(w, "(AS58807) overlaps 2402:4f00::/32 (AS58453)") &&
+			!strings.Contains(w, "202.97.224.0/19 (AS4837) overlaps 202.97.0.0/16 (AS4134)") {
+			t.Errorf("unexpected warning: %s", w)
+		}
+	}
+	if len(warnings) != 8 {
+		t.Errorf("got %d warnings; want 8", len(warnings))
+	}
+}
+
+func TestRulesValidate(t *testing.T) {
+	r := &Rules{
+		Prefixes: []Prefix{
+			{CIDR: "10.0.0.0/8", ASN: "AS1"},
+			{CIDR: "10.1.0.0/16", ASN: "AS1"},
+			{CIDR: "10.2.0.0/16", ASN: "AS2"},
+			{CIDR: "10.2.0.0/16", ASN: "AS3"},
+		},
+		Lines: []Line{{ASN: "AS1", Name: "one"}},
+	}
+	warnings, err := r.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.1.0.0/16 (AS1) is redundant", "10.2.0.0/16 (AS2) overlaps 10.0.0.0/8", "10.2.0.0/16 (AS2) is shadowed"}
+	if len(warnings) != len(want) {
+		t.Fatalf("got warnings %q", warnings)
+	}
+	for i := range want {
+		if !strings.Contains(warnings[i], want[i]) {
+			t.Errorf("warning %d: got %q; want %q", i, warnings[i], want[i])
+		}
+	}
+	r.Lines[0].Color = "pink"
+	if _, err := r.Validate(); err == nil {
+		t.Error("unknown color accepted")
+	}
+	r.Lines[0].Color = ""
+	r.Prefixes = append(r.Prefixes, Prefix{CIDR: "10.3.0.0", ASN: "AS4"})
+	if _, err := r.Validate(); err == nil {
+		t.Error("invalid prefix accepted")
+	}
+}
+
+func TestLoadAndSetRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	data := `{"prefixes": [{"cidr": "192.0.2.0/24", "asn": "AS64500"}], "lines": [{"asn": "AS64500", "name": "测试线路", "tier": "精品线路", "color": "cyan"}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetRules(r); err != nil {
+		t.Fatal(err)
+	}
+	defer SetRules(DefaultRules())
+	if got := ipAsn("192.0.2.1"); got != "AS64500" {
+		t.Errorf("ipAsn(192.0.2.1) = %q; want AS64500", got)
+	}
+	if got := ipAsn("59.43.1.1"); got != "" {
+		t.Errorf("ipAsn(59.43.1.1) = %q after swapping rules; want none", got)
+	}
+	if lines := classify([]string{"AS64500"}, nil, currentRules()); len(lines) != 1 || lines[0].Name != "测试线路" {
+		t.Errorf("got lines %v", lines)
+	}
+}
@@ -0,0 +1,243 @@
+package backtrace
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// SimHop is a router on a simulated route. The ASN of a hop follows from its
+// addresses just like on the real network.
+type SimHop struct {
+	// IPs are the interfaces answering at this hop, more than one simulates
+	// an ECMP load balancer which picks an interface by hashing the flow.
+	IPs []string
+	// RTT is the delay of replies from this hop.
+	RTT time.Duration
+	// Loss is the fraction of probes expiring here which are not answered.
+	Loss float64
+}
+
+// SimRoute is the path towards a simulated destination.
+type SimRoute struct {
+	Dst  string
+	Hops []SimHop
+	// RTT is the delay of replies from the destination itself.
+	RTT time.Duration
+	// Silent destinations do not answer probes reaching them.
+	Silent bool
+}
+
+// SimNetwork is an in-memory Transport simulating a network of routes, so
+// that Tracer can be tested without raw sockets. Its behaviour only depends
+// on the probes sent: the same probes always yield the same replies.
+type SimNetwork struct {
+	routes map[string]*SimRoute
+	ch     chan simReply
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+type simReply struct {
+	proto int
+	from  net.IP
+	data  []byte
+}
+
+// NewSimNetwork returns a simulated network made of routes.
+func NewSimNetwork(routes ...SimRoute) *SimNetwork {
+	n := &SimNetwork{
+		routes: make(map[string]*SimRoute),
+		ch:     make(chan simReply, 1024),
+		done:   make(chan struct{}),
+	}
+	for i := range routes {
+		r := routes[i]
+		n.routes[net.ParseIP(r.Dst).String()] = &r
+	}
+	return n
+}
+
+// WriteTo implements Transport.
+func (n *SimNetwork) WriteTo(b []byte, dst net.IP) error {
+	if len(b) < 1 {
+		return errMessageTooShort
+	}
+	p := make([]byte, len(b))
+	copy(p, b)
+	var (
+		proto, ttl int
+		payload    []byte
+	)
+	switch p[0] >> 4 {
+	case ipv4.Version:
+		h, err := ipv4.ParseHeader(p)
+		if err != nil {
+			return err
+		}
+		proto, ttl, payload = h.Protocol, h.TTL, p[h.Len:]
+	case ipv6.Version:
+		h, err := ipv6.ParseHeader(p)
+		if err != nil {
+			return err
+		}
+		proto, ttl, payload = h.NextHeader, h.HopLimit, p[ipv6.HeaderLen:]
+	default:
+		return errUnsupportedProtocol
+	}
+	r, ok := n.routes[dst.String()]
+	if !ok || ttl < 1 {
+		return nil
+	}
+	if ttl <= len(r.Hops) {
+		hop := r.Hops[ttl-1]
+		if len(hop.IPs) == 0 || simHash(p) < hop.Loss {
+			return nil
+		}
+		from := net.ParseIP(hop.IPs[simFlow(ttl, proto, payload)%uint32(len(hop.IPs))])
+		n.reply(hop.RTT, simError(dst, true, p), from)
+		return nil
+	}
+	if r.Silent {
+		return nil
+	}
+	switch proto {
+	case ProtocolICMP, ProtocolIPv6ICMP:
+		n.reply(r.RTT, simEchoReply(dst, payload), dst)
+	case ProtocolUDP:
+		n.reply(r.RTT, simError(dst, false, p), dst)
+	case ProtocolTCP:
+		n.reply(r.RTT, simReply{ProtocolTCP, nil, simSynAck(payload)}, dst)
+	}
+	return nil
+}
+
+// ReadFrom implements Transport.
+func (n *SimNetwork) ReadFrom(b []byte) (int, int, net.IP, error) {
+	select {
+	case r := <-n.ch:
+		return copy(b, r.data), r.proto, r.from, nil
+	case <-n.done:
+		return 0, 0, nil, net.ErrClosed
+	}
+}
+
+// Close implements Transport.
+func (n *SimNetwork) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.closed {
+		n.closed = true
+		close(n.done)
+	}
+	return nil
+}
+
+func (n *SimNetwork) reply(rtt time.Duration, r simReply, from net.IP) {
+	if r.data == nil {
+		return
+	}
+	r.from = from
+	time.AfterFunc(rtt, func() {
+		select {
+		case n.ch <- r:
+		case <-n.done:
+		}
+	})
+}
+
+// simError returns an ICMP time exceeded or port unreachable message quoting
+// packet p, as received by the router with a TTL of 1. Like many IPv4 routers
+// it quotes only 8 bytes of the transport header, and the IP ID is cleared as
+// a NAT may rewrite it.
+func simError(dst net.IP, exceeded bool, p []byte) simReply {
+	if dst.To4() == nil {
+		p[7] = 1
+		msg := icmp.Message{Type: ipv6.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: p}}
+		if !exceeded {
+			msg = icmp.Message{Type: ipv6.ICMPTypeDestinationUnreachable, Code: 4, Body: &icmp.DstUnreach{Data: p}}
+		}
+		b, _ := msg.Marshal(nil)
+		return simReply{proto: ProtocolIPv6ICMP, data: b}
+	}
+	p[8] = 1
+	p[4], p[5] = 0, 0
+	if hl := int(p[0]&0x0f) * 4; len(p) > hl+8 {
+		p = p[:hl+8]
+	}
+	msg := icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: p}}
+	if !exceeded {
+		msg = icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 3, Body: &icmp.DstUnreach{Data: p}}
+	}
+	b, _ := msg.Marshal(nil)
+	return simReply{proto: ProtocolICMP, data: b}
+}
+
+func simEchoReply(dst net.IP, payload []byte) simReply {
+	var typ icmp.Type = ipv4.ICMPTypeEchoReply
+	proto := ProtocolICMP
+	if dst.To4() == nil {
+		typ, proto = ipv6.ICMPTypeEchoReply, ProtocolIPv6ICMP
+	}
+	req, err := icmp.ParseMessage(proto, payload)
+	if err != nil {
+		return simReply{}
+	}
+	echo, ok := req.Body.(*icmp.Echo)
+	if !ok {
+		return simReply{}
+	}
+	b, _ := (&icmp.Message{Type: typ, Body: echo}).Marshal(nil)
+	return simReply{proto: proto, data: b}
+}
+
+func simSynAck(payload []byte) []byte {
+	if len(payload) < tcpHeaderLen {
+		return nil
+	}
+	b := make([]byte, tcpHeaderLen)
+	copy(b[0:2], payload[2:4])
+	copy(b[2:4], payload[0:2])
+	binary.BigEndian.PutUint32(b[8:12], binary.BigEndian.Uint32(payload[4:8])+1)
+	b[12] = tcpHeaderLen / 4 << 4
+	b[13] = tcpFlagSYN | tcpFlagACK
+	return b
+}
+
+// simFlow hashes the fields per-flow load balancers look at: the first four
+// bytes of the transport header, which are ICMP type, code and checksum or
+// UDP and TCP ports, plus the ICMP echo ID.
+func simFlow(ttl, proto int, payload []byte) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte{byte(ttl), byte(proto)})
+	if len(payload) >= 8 {
+		h.Write(payload[:4])
+		if proto == ProtocolICMP || proto == ProtocolIPv6ICMP {
+			h.Write(payload[4:6])
+		}
+	}
+	// FNV alone leaves the low bits periodic in the last byte written,
+	// mix them like the murmur3 finalizer before taking a modulus
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// simHash maps packet p to a number in [0, 1).
+func simHash(p []byte) float64 {
+	h := fnv.New32a()
+	h.Write(p)
+	return float64(h.Sum32()) / (1 << 32)
+}
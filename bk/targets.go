@@ -0,0 +1,252 @@
+package backtrace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Target 回程检测的目标地址
+// 含有 Alternates 切片，不能使用 == 比较或作为 map 的键，需要比较时使用 Name 和 IP
+type Target struct {
+	Name    string // 显示名称，如 北京电信
+	IP      string
+	Carrier string // 运营商，如 电信
+	City    string // 地区，如 北京
+	// Alternates 按优先级排列的备用地址，目标不响应时依次尝试
+	Alternates []string
+}
+
+var (
+	targets = []Target{
+		{"北京电信", "219.141.140.10", "电信", "北京", []string{"219.141.136.12", "219.141.136.10"}},
+		{"北京联通", "202.106.195.68", "联通", "北京", []string{"202.106.50.1", "202.106.0.20"}},
+		{"北京移动", "221.179.155.161", "移动", "北京", []string{"221.130.33.52", "221.130.33.60"}},
+		{"上海电信", "202.96.209.133", "电信", "上海", []string{"202.96.209.5", "116.228.111.118"}}, {"上海联通", "210.22.97.1", "联通", "上海", []string{"210.22.70.3"}}, {"上海移动", "211.136.112.200", "移动", "上海", []string{"211.136.112.50", "211.136.150.66"}},
+		{"广州电信", "58.60.188.222", "电信", "广州", []string{"202.96.128.86"}}, {"广州联通", "210.21.196.6", "联通", "广州", []string{"221.5.88.88"}}, {"广州移动", "120.196.165.24", "移动", "广州", []string{"211.136.192.6", "211.139.163.6"}},
+		{"成都电信", "61.139.2.69", "电信", "成都", []string{"218.6.200.139", "202.98.96.68"}}, {"成都联通", "119.6.6.6", "联通", "成都", []string{"124.161.87.155"}}, {"成都移动", "211.137.96.205", "移动", "成都", []string{"211.137.82.4"}},
+	}
+	// targetsExtra 教育网、科技网、广电等其他运营商的目标地址，需要单独开启
+	targetsExtra = []Target{
+		{"北京教育网", "101.6.6.6", "教育网", "北京", nil}, {"北京科技网", "159.226.8.6", "科技网", "北京", nil}, {"北京广电", "211.167.230.100", "广电", "北京", []string{"211.167.230.200"}},
+	}
+	targetsExtra6 = []Target{
+		{"北京教育网v6", "2001:da8::666", "教育网", "北京", nil},
+	}
+	targets6 = []Target{
+		{"北京电信v6", "240e:0:a::c9:5238", "电信", "北京", nil}, {"北京联通v6", "2408:80f0:4100:2005::3", "联通", "北京", nil}, {"北京移动v6", "2409:8089:1020:50ff:1000::fd01", "移动", "北京", nil},
+		{"上海电信v6", "240e:eb:8001:e01::53", "电信", "上海", nil}, {"上海联通v6", "2408:8000:9000:20e6::b7", "联通", "上海", nil}, {"上海移动v6", "2409:8c1e:75b0:1120::27", "移动", "上海", nil},
+		{"广州电信v6", "240e:97c:2f:1::5c", "电信", "广州", nil}, {"广州联通v6", "2408:8756:f50:1001::c", "联通", "广州", nil}, {"广州移动v6", "2409:8c54:871:1001::12", "移动", "广州", nil},
+		{"成都电信v6", "240e:56:4000:8000::69", "电信", "成都", nil}, {"成都联通v6", "2408:8662::2", "联通", "成都", nil}, {"成都移动v6", "2409:8062:2000:1::1", "移动", "成都", nil},
+	}
+)
+
+// regions 按大区划分的省份，省级目标组按此顺序分组输出
+var regions = []struct {
+	name      string
+	provinces []string
+}{
+	{"华北", []string{"北京", "天津", "河北", "山西", "内蒙古"}},
+	{"东北", []string{"辽宁", "吉林", "黑龙江"}},
+	{"华东", []string{"上海", "江苏", "浙江", "安徽", "福建", "江西", "山东"}},
+	{"华中", []string{"河南", "湖北", "湖南"}},
+	{"华南", []string{"广东", "广西", "海南"}},
+	{"西南", []string{"重庆", "四川", "贵州", "云南", "西藏"}},
+	{"西北", []string{"陕西", "甘肃", "青海", "宁夏", "新疆"}},
+}
+
+// provinceDNS 各省电信、联通、移动的DNS服务器，作为省级目标组的目标地址
+var provinceDNS = map[string][3]string{
+	"北京":  {"219.141.140.10", "202.106.195.68", "221.179.155.161"},
+	"天津":  {"219.150.32.132", "202.99.104.68", "211.137.160.5"},
+	"河北":  {"222.222.222.222", "202.99.160.68", "111.11.1.3"},
+	"山西":  {"219.149.135.188", "202.99.192.66", "211.138.106.2"},
+	"内蒙古": {"222.74.39.50", "202.99.224.68", "211.138.91.1"},
+	"辽宁":  {"219.148.204.66", "202.96.69.38", "211.137.32.178"},
+	"吉林":  {"219.149.194.55", "202.98.0.68", "211.141.16.99"},
+	"黑龙江": {"219.147.198.230", "202.97.224.69", "211.137.241.34"},
+	"上海":  {"202.96.209.133", "210.22.97.1", "211.136.112.200"},
+	"江苏":  {"218.2.2.2", "221.6.4.66", "221.131.143.69"},
+	"浙江":  {"202.101.172.35", "221.12.1.227", "211.140.13.188"},
+	"安徽":  {"61.132.163.68", "218.104.78.2", "211.138.180.2"},
+	"福建":  {"218.85.152.99", "218.104.128.106", "211.138.151.161"},
+	"江西":  {"202.101.224.69", "220.248.192.12", "211.141.90.68"},
+	"山东":  {"219.146.1.66", "202.102.128.68", "218.201.96.130"},
+	"河南":  {"222.88.88.88", "202.102.224.68", "211.138.24.66"},
+	"湖北":  {"202.103.24.68", "218.104.111.114", "211.137.58.20"},
+	"湖南":  {"222.246.129.80", "58.20.127.238", "211.142.210.98"},
+	"广东":  {"58.60.188.222", "210.21.196.6", "120.196.165.24"},
+	"广西":  {"202.103.225.68", "221.7.128.68", "211.138.245.180"},
+	"海南":  {"202.100.192.68", "221.11.132.2", "221.176.88.95"},
+	"重庆":  {"61.128.128.68", "221.5.203.98", "218.201.4.3"},
+	"四川":  {"61.139.2.69", "119.6.6.6", "211.137.96.205"},
+	"贵州":  {"202.98.192.67", "221.13.28.234", "211.139.5.29"},
+	"云南":  {"222.172.200.68", "221.3.131.11", "211.139.29.68"},
+	"西藏":  {"202.98.224.68", "221.13.65.34", "211.139.73.34"},
+	"陕西":  {"218.30.19.40", "221.11.1.67", "211.137.130.3"},
+	"甘肃":  {"202.100.64.68", "221.7.34.10", "218.203.160.194"},
+	"青海":  {"202.100.128.68", "221.207.58.58", "211.138.75.123"},
+	"宁夏":  {"222.75.152.129", "211.93.0.81", "218.203.123.116"},
+	"新疆":  {"61.128.114.166", "221.7.1.21", "218.202.152.130"},
+}
+
+// provinceTargets 按大区顺序生成各省三网的目标
+func provinceTargets() []Target {
+	var list []Target
+	for _, r := range regions {
+		for _, p := range r.provinces {
+			for i, carrier := range []string{"电信", "联通", "移动"} {
+				ip := provinceDNS[p][i]
+				list = append(list, Target{p + carrier, ip, carrier, p, alternatesOf(ip)})
+			}
+		}
+	}
+	return list
+}
+
+// alternatesOf 返回默认目标组中同一地址的备用地址
+// 省级目标组只有北京、上海、广东、四川与默认目标组重合，其余省份没有备用地址
+func alternatesOf(ip string) []string {
+	for _, t := range targets {
+		if t.IP == ip {
+			return t.Alternates
+		}
+	}
+	return nil
+}
+
+// RegionOf 返回省份所在的大区，未知时返回空
+func RegionOf(province string) string {
+	for _, r := range regions {
+		for _, p := range r.provinces {
+			if p == province {
+				return r.name
+			}
+		}
+	}
+	return ""
+}
+
+// preset 内置的一组目标地址，IPV4和IPV6分开
+type preset struct {
+	v4, v6  []Target
+	grouped bool // 输出时按大区分组
+}
+
+const (
+	// DefaultPreset 默认使用的内置目标组，北京、上海、广州、成都三网
+	DefaultPreset = "default"
+	// ProvincePreset 全国31个省份三网的内置目标组，仅有IPV4目标
+	ProvincePreset = "province"
+)
+
+var presets = map[string]preset{
+	DefaultPreset:  {v4: targets, v6: targets6},
+	ProvincePreset: {v4: provinceTargets(), grouped: true},
+}
+
+// Presets 返回内置目标组的名称
+func Presets() []string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PresetTargets 返回内置目标组中的目标地址，目标组没有所选IP版本的目标时返回 error
+func PresetTargets(name string, ipv4, ipv6 bool) ([]Target, error) {
+	if name == "" {
+		name = DefaultPreset
+	}
+	p, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q, available: %s", name, strings.Join(Presets(), ", "))
+	}
+	var list []Target
+	if ipv4 {
+		list = append(list, p.v4...)
+	}
+	if ipv6 {
+		list = append(list, p.v6...)
+	}
+	if len(list) == 0 && (ipv4 || ipv6) {
+		version := "IPv4"
+		if !ipv4 {
+			version = "IPv6"
+		}
+		return nil, fmt.Errorf("preset %q has no %s targets", name, version)
+	}
+	return list, nil
+}
+
+// ParseTarget 解析 名称,IP,运营商,地区 格式的目标，只有IP时名称使用IP
+// IP 可以用 | 分隔附带备用地址，如 202.106.195.68|202.106.0.20
+func ParseTarget(s string) (Target, error) {
+	fields := strings.Split(s, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	var t Target
+	if len(fields) == 1 {
+		t.Name, t.IP = fields[0], fields[0]
+	} else {
+		t.Name, t.IP = fields[0], fields[1]
+	}
+	if len(fields) > 2 {
+		t.Carrier = fields[2]
+	}
+	if len(fields) > 3 {
+		t.City = fields[3]
+	}
+	if len(fields) > 4 {
+		return t, fmt.Errorf("invalid target %q: too many fields", s)
+	}
+	ips := strings.Split(t.IP, "|")
+	for _, ip := range ips {
+		if net.ParseIP(strings.TrimSpace(ip)) == nil {
+			return t, fmt.Errorf("invalid target %q: bad ip address %q", s, ip)
+		}
+	}
+	if len(fields) == 1 {
+		t.Name = strings.TrimSpace(ips[0])
+	}
+	t.IP = strings.TrimSpace(ips[0])
+	for _, ip := range ips[1:] {
+		t.Alternates = append(t.Alternates, strings.TrimSpace(ip))
+	}
+	return t, nil
+}
+
+// ReadTargets 逐行读取目标，每行一个，格式同 ParseTarget，空行和 # 开头的注释行被忽略
+func ReadTargets(r io.Reader) ([]Target, error) {
+	var list []Target
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t, err := ParseTarget(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		list = append(list, t)
+	}
+	return list, sc.Err()
+}
+
+// LoadTargets 读取目标文件
+func LoadTargets(path string) ([]Target, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTargets(f)
+}
@@ -0,0 +1,127 @@
+package backtrace
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTargets(t *testing.T) {
+	list, err := ReadTargets(strings.NewReader(`
+# 办公网出口
+杭州办公室, 192.0.2.10, 电信, 杭州
+192.0.2.20|192.0.2.21 | 192.0.2.22
+深圳机房,2001:db8::1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Target{
+		{"杭州办公室", "192.0.2.10", "电信", "杭州", nil},
+		{"192.0.2.20", "192.0.2.20", "", "", []string{"192.0.2.21", "192.0.2.22"}},
+		{"深圳机房", "2001:db8::1", "", "", nil},
+	}
+	if len(list) != len(want) {
+		t.Fatalf("got %v; want %v", list, want)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(list[i], want[i]) {
+			t.Errorf("target %d: got %v; want %v", i, list[i], want[i])
+		}
+	}
+	for _, s := range []string{"办公室,192.0.2", "a,192.0.2.1,b,c,d", "localhost", "a,192.0.2.1|x"} {
+		if _, err := ReadTargets(strings.NewReader(s)); err == nil {
+			t.Errorf("ReadTargets(%q) accepted", s)
+		}
+	}
+}
+
+func TestPresetTargets(t *testing.T) {
+	list, err := PresetTargets("", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != len(targets)+len(targets6) {
+		t.Errorf("got %d default targets; want %d", len(list), len(targets)+len(targets6))
+	}
+	list, err = PresetTargets(ProvincePreset, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provinceDNS) != 31 || len(list) != 31*3 {
+		t.Errorf("got %d provinces and %d targets; want 31 and 93", len(provinceDNS), len(list))
+	}
+	for _, tgt := range list {
+		if net.ParseIP(tgt.IP) == nil || RegionOf(tgt.City) == "" {
+			t.Errorf("bad province target %+v", tgt)
+		}
+		// 目标不能落在其他运营商的骨干网地址段内，否则目标本身会被识别为其他运营商的线路
+		if p := lookupPrefix(net.ParseIP(tgt.IP)); p != nil && p.Carrier != tgt.Carrier {
+			t.Errorf("province target %+v is in %s of %s", tgt, p.ASN, p.Carrier)
+		}
+	}
+	if _, err := PresetTargets("nowhere", true, false); err == nil {
+		t.Error("unknown preset accepted")
+	}
+	// 省级目标组没有IPV6目标，只检测IPV6时报错而不是返回空列表
+	if list, err := PresetTargets(ProvincePreset, false, true); err == nil || !strings.Contains(err.Error(), "IPv6") {
+		t.Errorf("got %d targets, err %v; want an error", len(list), err)
+	}
+	if list, err := PresetTargets(ProvincePreset, true, true); err != nil || len(list) != 31*3 {
+		t.Errorf("got %d targets, err %v", len(list), err)
+	}
+}
+
+func TestBackTraceTargets(t *testing.T) {
+	list := []Target{{"办公室", "192.0.2.10", "电信", "杭州", nil}, {"机房", "2001:db8::1", "", "", nil}}
+	withSimTracer(t, simRoute(list[0].IP, "10.0.0.1", "202.97.1.1"), simRoute(list[1].IP, "fd00::1", "240e:1::1"))
+	results, err := BackTraceContext(context.Background(), Options{IPv4: true, Targets: list})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results; want 2", len(results))
+	}
+	for i, r := range results {
+		if !reflect.DeepEqual(r.Target, list[i]) || len(r.Lines) != 1 || r.Lines[0] != line("AS4134") {
+			t.Errorf("result %d: %+v", i, r)
+		}
+	}
+}
+
+func TestBackTracePreflight(t *testing.T) {
+	silent := simRoute("192.0.2.10", "10.0.0.1", "202.97.1.1")
+	silent.Silent = true
+	alt := simRoute("192.0.2.11", "10.0.0.1", "219.158.1.1")
+	down := simRoute("192.0.2.20", "10.0.0.1")
+	down.Silent = true
+	withSimTracer(t, silent, alt, down)
+	list := []Target{
+		{"联通", "192.0.2.10", "联通", "北京", []string{"192.0.2.12", "192.0.2.11"}},
+		{"电信", "192.0.2.20", "电信", "北京", nil},
+	}
+	results, err := BackTraceContext(context.Background(), Options{Targets: list, Preflight: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := results[0]
+	if r.UsedIP != "192.0.2.11" || r.Unreachable || len(r.Skipped) != 2 || r.Skipped[0].IP != "192.0.2.10" || r.Skipped[1].IP != "192.0.2.12" {
+		t.Errorf("got used %s skipped %v", r.UsedIP, r.Skipped)
+	}
+	if len(r.Lines) != 1 || r.Lines[0] != line("AS4837") {
+		t.Errorf("got lines %v from the alternate", r.Lines)
+	}
+	if s := FormatResult(r); !strings.Contains(s, "已跳过 192.0.2.10 ") || !strings.Contains(s, "192.0.2.12 ") {
+		t.Errorf("skipped addresses not rendered: %q", s)
+	}
+	r = results[1]
+	if r.UsedIP != "192.0.2.20" || !r.Unreachable {
+		t.Errorf("got used %s unreachable %v", r.UsedIP, r.Unreachable)
+	}
+	if s := FormatResult(r); !strings.Contains(s, "目标及备用地址均无响应") {
+		t.Errorf("got %q", s)
+	}
+}
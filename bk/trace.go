@@ -2,6 +2,7 @@ package backtrace
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"net"
 	"sort"
@@ -16,11 +17,13 @@ import (
 
 // DefaultConfig is the default configuration for Tracer.
 var DefaultConfig = Config{
-	Delay:    50 * time.Millisecond,
-	Timeout:  500 * time.Millisecond,
-	MaxHops:  15,
-	Count:    1,
-	Networks: []string{"ip4:icmp", "ip4:ip"},
+	Delay:     50 * time.Millisecond,
+	Timeout:   500 * time.Millisecond,
+	MaxHops:   15,
+	Count:     1,
+	Networks:  []string{"ip4:icmp", "ip4:ip"},
+	Networks6: []string{"ip6:ipv6-icmp"},
+	Probe:     ProbeICMP,
 }
 
 // DefaultTracer is a tracer with DefaultConfig.
@@ -30,22 +33,69 @@ var DefaultTracer = &Tracer{
 
 // Config is a configuration for Tracer.
 type Config struct {
-	Delay    time.Duration
-	Timeout  time.Duration
-	MaxHops  int
-	Count    int
-	Networks []string
-	Addr     *net.IPAddr
+	Delay     time.Duration
+	Timeout   time.Duration
+	MaxHops   int
+	Count     int
+	Networks  []string
+	Networks6 []string
+	Addr      *net.IPAddr
+	// Probe selects the probe packet type, ProbeICMP if empty.
+	Probe string
+	// Port is the destination port of UDP and TCP probes,
+	// 33434 for UDP and 80 for TCP if zero.
+	Port int
+	// Paris keeps the flow identifier (ICMP ID and checksum, UDP and TCP ports)
+	// constant for all probes of a session, so per-flow load balancers forward
+	// them along a single path like paris-traceroute.
+	Paris bool
+	// Confidence is the probability with which TraceMultipath finds all
+	// next hops of a load balancer, 0.95 if zero.
+	Confidence float64
+	// Transport replaces the raw sockets of Tracer if not nil.
+	Transport Transport
 }
 
+// Transport sends probe packets and receives replies on behalf of Tracer,
+// it allows tracing over other means than raw sockets such as SimNetwork.
+type Transport interface {
+	// WriteTo sends the IPv4 or IPv6 packet b, including its header, to dst.
+	// Checksums of IPv6 packets are left zero for the transport to fill.
+	WriteTo(b []byte, dst net.IP) error
+	// ReadFrom reads the payload of a received packet into b and returns its
+	// length, IP protocol number and source address. Only ICMP, ICMPv6 and
+	// TCP packets are of interest to Tracer.
+	ReadFrom(b []byte) (n int, proto int, from net.IP, err error)
+	// Close closes the transport, pending ReadFrom calls return an error.
+	Close() error
+}
+
+// Probe types supported by Tracer.
+const (
+	ProbeICMP = "icmp"
+	ProbeUDP  = "udp"
+	ProbeTCP  = "tcp"
+)
+
 // Tracer is a traceroute tool based on raw IP packets.
 // It can handle multiple sessions simultaneously.
+// If raw sockets can not be opened, IPv4 ICMP tracing falls back to
+// unprivileged ICMP datagram sockets where the system supports them.
 type Tracer struct {
 	Config
 
-	once sync.Once
-	conn *net.IPConn
-	err  error
+	once  sync.Once
+	conn  *net.IPConn
+	tcp4  *net.IPConn
+	dgram *net.UDPConn
+	err   error
+	wmu   sync.Mutex
+
+	once6 sync.Once
+	conn6 *ipv6.PacketConn
+	raw6  *ipv6.PacketConn
+	err6  error
+	wmu6  sync.Mutex
 
 	mu   sync.RWMutex
 	sess map[string][]*Session
@@ -104,8 +154,67 @@ func (t *Tracer) Trace(ctx context.Context, ip net.IP, h func(reply *Reply)) err
 	}
 }
 
+// reachableTTL is the TTL of Reachable probes. It does not depend on MaxHops,
+// so targets farther away than the traced hops still answer.
+const reachableTTL = 64
+
+// Reachable reports whether ip answers probes within timeout. Up to three
+// probes are sent with reachableTTL, so any reply from ip itself counts.
+func (t *Tracer) Reachable(ctx context.Context, ip net.IP, timeout time.Duration) (bool, error) {
+	sess, err := t.NewSession(ip)
+	if err != nil {
+		return false, err
+	}
+	defer sess.Close()
+
+	deadline := time.After(timeout)
+	retry := time.NewTicker(timeout / 3)
+	defer retry.Stop()
+	// PingFlow adds 1 to the TTL
+	if err := sess.Ping(reachableTTL - 1); err != nil {
+		return false, err
+	}
+	for n := 1; ; {
+		select {
+		case r := <-sess.Receive():
+			if ip.Equal(r.IP) {
+				return true, nil
+			}
+		case <-retry.C:
+			if n < 3 {
+				n++
+				if err := sess.Ping(reachableTTL - 1); err != nil {
+					return false, err
+				}
+			}
+		case <-deadline:
+			return false, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
 // NewSession returns new tracer session.
 func (t *Tracer) NewSession(ip net.IP) (*Session, error) {
+	switch t.Probe {
+	case "", ProbeICMP, ProbeUDP, ProbeTCP:
+	default:
+		return nil, errUnsupportedProtocol
+	}
+	if t.Transport != nil {
+		t.once.Do(func() {
+			go t.serveTransport(t.Transport)
+		})
+		return newSession(t, shortIP(ip)), nil
+	}
+	if ip.To4() == nil {
+		t.once6.Do(t.init6)
+		if t.err6 != nil {
+			return nil, t.err6
+		}
+		return newSession(t, shortIP(ip)), nil
+	}
 	t.once.Do(t.init)
 	if t.err != nil {
 		return nil, t.err
@@ -119,11 +228,74 @@ func (t *Tracer) init() {
 		if t.err != nil {
 			continue
 		}
-		go t.serve(t.conn)
+		if t.Probe == ProbeTCP {
+			// SYN-ACK and RST replies are only delivered to raw TCP sockets
+			t.tcp4, t.err = net.ListenIP("ip4:tcp", t.Addr)
+			if t.err != nil {
+				t.conn.Close()
+				return
+			}
+			go t.serve(t.tcp4, t.serveTCP)
+		}
+		go t.serve(t.conn, t.serveData)
+		return
+	}
+	if t.err == nil || (t.Probe != "" && t.Probe != ProbeICMP) {
+		return
+	}
+	dgram, err := t.listenDgram(t.Addr)
+	if err != nil {
+		return
+	}
+	t.dgram, t.err = dgram, nil
+	go t.serveDgram(t.dgram)
+}
+
+func (t *Tracer) init6() {
+	laddr := t.Addr
+	if laddr != nil && laddr.IP.To4() != nil {
+		laddr = nil
+	}
+	t.err6 = errUnsupportedProtocol
+	for _, network := range t.Networks6 {
+		t.conn6, t.err6 = t.listen6(network, laddr)
+		if t.err6 != nil {
+			continue
+		}
+		switch t.Probe {
+		case ProbeUDP:
+			t.raw6, t.err6 = listenRaw6("ip6:udp", laddr, 6)
+		case ProbeTCP:
+			t.raw6, t.err6 = listenRaw6("ip6:tcp", laddr, 16)
+			if t.err6 == nil {
+				go t.serve6(t.raw6, t.serveTCP)
+			}
+		}
+		if t.err6 != nil {
+			t.conn6.Close()
+			return
+		}
+		go t.serve6(t.conn6, t.serveData)
 		return
 	}
 }
 
+// listenRaw6 opens a raw IPv6 socket used to send probes of a transport protocol.
+// The kernel computes the checksum found at offset of each packet.
+func listenRaw6(network string, laddr *net.IPAddr, offset int) (*ipv6.PacketConn, error) {
+	conn, err := net.ListenIP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	p := ipv6.NewPacketConn(conn)
+	err = p.SetChecksum(true, offset)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
 // Close closes listening socket.
 // Tracer can not be used after Close is called.
 func (t *Tracer) Close() {
@@ -132,9 +304,43 @@ func (t *Tracer) Close() {
 	if t.conn != nil {
 		t.conn.Close()
 	}
+	if t.conn6 != nil {
+		t.conn6.Close()
+	}
+	if t.tcp4 != nil {
+		t.tcp4.Close()
+	}
+	if t.dgram != nil {
+		t.dgram.Close()
+	}
+	if t.raw6 != nil {
+		t.raw6.Close()
+	}
+	if t.Transport != nil {
+		t.Transport.Close()
+	}
+}
+
+func (t *Tracer) serveTransport(tr Transport) error {
+	buf := make([]byte, 1500)
+	for {
+		n, proto, from, err := tr.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		switch proto {
+		case ProtocolICMP, ProtocolIPv6ICMP:
+			err = t.serveData(from, buf[:n])
+		case ProtocolTCP:
+			err = t.serveTCP(from, buf[:n])
+		}
+		if err != nil {
+			continue
+		}
+	}
 }
 
-func (t *Tracer) serve(conn *net.IPConn) error {
+func (t *Tracer) serve(conn *net.IPConn, serveData func(from net.IP, b []byte) error) error {
 	defer conn.Close()
 	buf := make([]byte, 1500)
 	for {
@@ -142,7 +348,26 @@ func (t *Tracer) serve(conn *net.IPConn) error {
 		if err != nil {
 			return err
 		}
-		err = t.serveData(from.IP, buf[:n])
+		err = serveData(from.IP, buf[:n])
+		if err != nil {
+			continue
+		}
+	}
+}
+
+func (t *Tracer) serve6(conn *ipv6.PacketConn, serveData func(from net.IP, b []byte) error) error {
+	defer conn.Close()
+	buf := make([]byte, 1500)
+	for {
+		n, _, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		ip, ok := from.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		err = serveData(ip.IP, buf[:n])
 		if err != nil {
 			continue
 		}
@@ -151,8 +376,7 @@ func (t *Tracer) serve(conn *net.IPConn) error {
 
 func (t *Tracer) serveData(from net.IP, b []byte) error {
 	if from.To4() == nil {
-		// TODO: implement ProtocolIPv6ICMP
-		return errUnsupportedProtocol
+		return t.serveData6(from, b)
 	}
 	now := time.Now()
 	msg, err := icmp.ParseMessage(ProtocolICMP, b)
@@ -161,7 +385,7 @@ func (t *Tracer) serveData(from net.IP, b []byte) error {
 	}
 	if msg.Type == ipv4.ICMPTypeEchoReply {
 		echo := msg.Body.(*icmp.Echo)
-		return t.serveReply(from, &packet{from, uint16(echo.ID), 1, now})
+		return t.serveReply(from, &packet{from, uint16(echo.Seq), 1, now})
 	}
 	b = getReplyData(msg)
 	if len(b) < ipv4.HeaderLen {
@@ -173,7 +397,11 @@ func (t *Tracer) serveData(from net.IP, b []byte) error {
 		if err != nil {
 			return err
 		}
-		return t.serveReply(ip.Dst, &packet{from, uint16(ip.ID), ip.TTL, now})
+		id, err := quotedID(ip.Protocol, b[ip.Len:])
+		if err != nil {
+			return err
+		}
+		return t.serveReply(ip.Dst, &packet{from, id, ip.TTL, now})
 	case ipv6.Version:
 		ip, err := ipv6.ParseHeader(b)
 		if err != nil {
@@ -185,9 +413,125 @@ func (t *Tracer) serveData(from net.IP, b []byte) error {
 	}
 }
 
-func (t *Tracer) sendRequest(dst net.IP, ttl int) (*packet, error) {
-	id := uint16(atomic.AddUint32(&t.seq, 1))
-	b := newPacket(id, dst, ttl)
+// quotedID returns the probe ID from the transport header quoted in an ICMP
+// error. Only its first 8 bytes are sure to be quoted and NATs may rewrite the
+// IP ID, so the ID is taken from the echo sequence number, the UDP checksum
+// or the TCP sequence number.
+func quotedID(proto int, p []byte) (uint16, error) {
+	if len(p) < 8 {
+		return 0, errMessageTooShort
+	}
+	switch proto {
+	case ProtocolICMP:
+		if ipv4.ICMPType(p[0]) != ipv4.ICMPTypeEcho {
+			return 0, errUnsupportedProtocol
+		}
+		return binary.BigEndian.Uint16(p[6:8]), nil
+	case ProtocolUDP:
+		return binary.BigEndian.Uint16(p[6:8]), nil
+	case ProtocolTCP:
+		return uint16(binary.BigEndian.Uint32(p[4:8])), nil
+	default:
+		return 0, errUnsupportedProtocol
+	}
+}
+
+// serveData6 handles ICMPv6 messages. The quoted IPv6 header carries no
+// identification field, so requests are matched by the sequence number of the
+// quoted echo, the first payload bytes of the quoted UDP datagram or the quoted
+// TCP sequence number.
+func (t *Tracer) serveData6(from net.IP, b []byte) error {
+	now := time.Now()
+	msg, err := icmp.ParseMessage(ProtocolIPv6ICMP, b)
+	if err != nil {
+		return err
+	}
+	if msg.Type == ipv6.ICMPTypeEchoReply {
+		echo := msg.Body.(*icmp.Echo)
+		return t.serveReply(from, &packet{from, uint16(echo.Seq), 1, now})
+	}
+	b = getReplyData(msg)
+	if len(b) < ipv6.HeaderLen+8 {
+		return errMessageTooShort
+	}
+	ip, err := ipv6.ParseHeader(b)
+	if err != nil {
+		return err
+	}
+	var id uint16
+	p := b[ipv6.HeaderLen:]
+	switch ip.NextHeader {
+	case ProtocolIPv6ICMP:
+		if ipv6.ICMPType(p[0]) != ipv6.ICMPTypeEchoRequest {
+			return errUnsupportedProtocol
+		}
+		id = binary.BigEndian.Uint16(p[6:8])
+	case ProtocolUDP:
+		if len(p) < udpHeaderLen+2 {
+			return errMessageTooShort
+		}
+		id = binary.BigEndian.Uint16(p[udpHeaderLen : udpHeaderLen+2])
+	case ProtocolTCP:
+		id = uint16(binary.BigEndian.Uint32(p[4:8]))
+	default:
+		return errUnsupportedProtocol
+	}
+	return t.serveReply(ip.Dst, &packet{from, id, ip.HopLimit, now})
+}
+
+// serveTCP handles TCP segments, a SYN-ACK or RST acknowledging one of our
+// SYN probes means the probe has arrived at the destination.
+func (t *Tracer) serveTCP(from net.IP, b []byte) error {
+	now := time.Now()
+	if len(b) < tcpHeaderLen {
+		return errMessageTooShort
+	}
+	flags := b[13]
+	if flags&tcpFlagACK == 0 || flags&(tcpFlagSYN|tcpFlagRST) == 0 {
+		return errUnsupportedProtocol
+	}
+	// The answer comes from the port we probed, segments of other
+	// connections to the same host are not ours.
+	if binary.BigEndian.Uint16(b[0:2]) != uint16(t.port()) {
+		return errUnsupportedProtocol
+	}
+	id := uint16(binary.BigEndian.Uint32(b[8:12]) - 1)
+	return t.serveReply(from, &packet{from, id, 1, now})
+}
+
+// sendRequest sends a probe with the given flow identifier,
+// a zero flow uses the probe ID so every probe is a different flow.
+func (t *Tracer) sendRequest(dst net.IP, ttl int, flow uint16) (*packet, error) {
+	id := t.nextID()
+	if flow == 0 {
+		flow = id
+	}
+	if t.Transport != nil {
+		return t.sendTransport(id, flow, dst, ttl)
+	}
+	if dst.To4() == nil {
+		return t.sendRequest6(id, flow, dst, ttl)
+	}
+	if t.dgram != nil {
+		return t.sendDgram(id, flow, dst, ttl)
+	}
+	var b []byte
+	switch t.Probe {
+	case ProbeUDP:
+		src, err := t.sourceIP(dst)
+		if err != nil {
+			return nil, err
+		}
+		b = newUDPPacket(id, flow, t.port(), src, dst, ttl)
+	case ProbeTCP:
+		src, err := t.sourceIP(dst)
+		if err != nil {
+			return nil, err
+		}
+		b = newTCPPacket(id, flow, t.port(), src, dst, ttl)
+	default:
+		b = newPacket(id, flow, dst, ttl)
+	}
 	req := &packet{dst, id, ttl, time.Now()}
 	_, err := t.conn.WriteToIP(b, &net.IPAddr{IP: dst})
 	if err != nil {
@@ -196,6 +540,138 @@ func (t *Tracer) sendRequest(dst net.IP, ttl int) (*packet, error) {
 	return req, nil
 }
 
+// sendRequest6 sends an IPv6 probe. Raw IPv6 sockets can not carry
+// our own header, so the hop limit is set on the socket before each write.
+func (t *Tracer) sendRequest6(id, flow uint16, dst net.IP, ttl int) (*packet, error) {
+	conn := t.conn6
+	var b []byte
+	switch t.Probe {
+	case ProbeUDP:
+		conn = t.raw6
+		b = newUDPHeader(id, flow, t.port())
+	case ProbeTCP:
+		conn = t.raw6
+		b = newTCPHeader(id, flow, t.port(), nil, nil)
+	default:
+		b = newPacket6(id, flow)
+	}
+	t.wmu6.Lock()
+	defer t.wmu6.Unlock()
+	err := conn.SetHopLimit(ttl)
+	if err != nil {
+		return nil, err
+	}
+	req := &packet{dst, id, ttl, time.Now()}
+	_, err = conn.WriteTo(b, nil, &net.IPAddr{IP: dst})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// sendTransport builds a complete IPv4 or IPv6 probe and sends it over t.Transport.
+func (t *Tracer) sendTransport(id, flow uint16, dst net.IP, ttl int) (*packet, error) {
+	var b []byte
+	if dst.To4() == nil {
+		switch t.Probe {
+		case ProbeUDP:
+			b = newIPv6Packet(ProtocolUDP, dst, ttl, newUDPHeader(id, flow, t.port()))
+		case ProbeTCP:
+			b = newIPv6Packet(ProtocolTCP, dst, ttl, newTCPHeader(id, flow, t.port(), nil, nil))
+		default:
+			b = newIPv6Packet(ProtocolIPv6ICMP, dst, ttl, newPacket6(id, flow))
+		}
+	} else {
+		switch t.Probe {
+		case ProbeUDP:
+			src, err := t.sourceIP(dst)
+			if err != nil {
+				return nil, err
+			}
+			b = newUDPPacket(id, flow, t.port(), src, dst, ttl)
+		case ProbeTCP:
+			src, err := t.sourceIP(dst)
+			if err != nil {
+				return nil, err
+			}
+			b = newTCPPacket(id, flow, t.port(), src, dst, ttl)
+		default:
+			b = newPacket(id, flow, dst, ttl)
+		}
+	}
+	req := &packet{dst, id, ttl, time.Now()}
+	err := t.Transport.WriteTo(b, dst)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// sendDgram sends an ICMP echo request over an unprivileged ICMP socket.
+// The kernel replaces the echo ID by the socket port, so replies are matched
+// by sequence number, and TTL can only be set for the whole socket.
+func (t *Tracer) sendDgram(id, flow uint16, dst net.IP, ttl int) (*packet, error) {
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{
+			ID:   int(flow),
+			Seq:  int(id),
+			Data: flowData(id),
+		},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	err = ipv4.NewPacketConn(t.dgram).SetTTL(ttl)
+	if err != nil {
+		return nil, err
+	}
+	req := &packet{dst, id, ttl, time.Now()}
+	_, err = t.dgram.WriteTo(b, &net.UDPAddr{IP: dst})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// nextID returns a new probe ID, zero is skipped as it is not a valid port.
+func (t *Tracer) nextID() uint16 {
+	for {
+		id := uint16(atomic.AddUint32(&t.seq, 1))
+		if id != 0 {
+			return id
+		}
+	}
+}
+
+// port returns the destination port of UDP and TCP probes.
+func (t *Tracer) port() int {
+	if t.Port != 0 {
+		return t.Port
+	}
+	if t.Probe == ProbeTCP {
+		return 80
+	}
+	return 33434
+}
+
+// sourceIP returns the local IPv4 address used to reach dst,
+// which is needed for the TCP checksum.
+func (t *Tracer) sourceIP(dst net.IP) (net.IP, error) {
+	if t.Addr != nil && t.Addr.IP.To4() != nil && !t.Addr.IP.IsUnspecified() {
+		return t.Addr.IP.To4(), nil
+	}
+	conn, err := net.Dial("udp4", net.JoinHostPort(dst.String(), "80"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.To4(), nil
+}
+
 func (t *Tracer) addSession(s *Session) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -229,12 +705,14 @@ func (t *Tracer) serveReply(dst net.IP, res *packet) error {
 
 // Session is a tracer session.
 type Session struct {
-	t  *Tracer
-	ip net.IP
-	ch chan *Reply
+	t    *Tracer
+	ip   net.IP
+	ch   chan *Reply
+	flow uint16
 
 	mu     sync.RWMutex
 	probes []*packet
+	flows  map[uint16]uint16
 }
 
 // NewSession returns new session.
@@ -248,18 +726,33 @@ func newSession(t *Tracer, ip net.IP) *Session {
 		ip: ip,
 		ch: make(chan *Reply, 64),
 	}
+	if t.Paris {
+		s.flow = t.nextID()
+	}
 	t.addSession(s)
 	return s
 }
 
-// Ping sends single ICMP packet with specified TTL.
+// Ping sends single probe packet with specified TTL (hop limit for IPv6).
 func (s *Session) Ping(ttl int) error {
-	req, err := s.t.sendRequest(s.ip, ttl+1)
+	return s.PingFlow(ttl, s.flow)
+}
+
+// PingFlow sends single probe packet with specified TTL and flow identifier,
+// which is reported back in Reply.Flow.
+func (s *Session) PingFlow(ttl int, flow uint16) error {
+	req, err := s.t.sendRequest(s.ip, ttl+1, flow)
 	if err != nil {
 		return err
 	}
 	s.mu.Lock()
 	s.probes = append(s.probes, req)
+	if flow != 0 {
+		if s.flows == nil {
+			s.flows = make(map[uint16]uint16)
+		}
+		s.flows[req.ID] = flow
+	}
 	s.mu.Unlock()
 	return nil
 }
@@ -285,13 +778,17 @@ func (s *Session) handle(res *packet) {
 	now := res.Time
 	n := 0
 	var req *packet
+	var flow uint16
 	s.mu.Lock()
 	for _, r := range s.probes {
 		if now.Sub(r.Time) > s.t.Timeout {
+			delete(s.flows, r.ID)
 			continue
 		}
 		if r.ID == res.ID {
 			req = r
+			flow = s.flows[r.ID]
+			delete(s.flows, r.ID)
 			continue
 		}
 		s.probes[n] = r
@@ -311,6 +808,7 @@ func (s *Session) handle(res *packet) {
 		IP:   res.IP,
 		RTT:  res.Time.Sub(req.Time),
 		Hops: hops,
+		Flow: flow,
 	}:
 	default:
 	}
@@ -353,13 +851,14 @@ var (
 	errNoReplyData         = errors.New("no reply data")
 )
 
-func newPacket(id uint16, dst net.IP, ttl int) []byte {
+func newPacket(id, flow uint16, dst net.IP, ttl int) []byte {
 	// TODO: reuse buffers...
 	msg := icmp.Message{
 		Type: ipv4.ICMPTypeEcho,
 		Body: &icmp.Echo{
-			ID:  int(id),
-			Seq: int(id),
+			ID:   int(flow),
+			Seq:  int(id),
+			Data: flowData(id),
 		},
 	}
 	p, _ := msg.Marshal(nil)
@@ -380,6 +879,152 @@ func newPacket(id uint16, dst net.IP, ttl int) []byte {
 	return append(buf, p...)
 }
 
+// newPacket6 builds an ICMPv6 echo request, the checksum is filled by the kernel.
+func newPacket6(id, flow uint16) []byte {
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeEchoRequest,
+		Body: &icmp.Echo{
+			ID:   int(flow),
+			Seq:  int(id),
+			Data: flowData(id),
+		},
+	}
+	p, _ := msg.Marshal(nil)
+	return p
+}
+
+// newIPv6Packet prepends an IPv6 header with an unspecified source to payload p.
+func newIPv6Packet(proto int, dst net.IP, ttl int, p []byte) []byte {
+	b := make([]byte, ipv6.HeaderLen, ipv6.HeaderLen+len(p))
+	b[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(p)))
+	b[6] = byte(proto)
+	b[7] = byte(ttl)
+	copy(b[24:40], dst.To16())
+	return append(b, p...)
+}
+
+// newUDPPacket builds an IPv4 UDP probe. ICMP errors may quote only the UDP
+// header, so the checksum carries the probe ID: the last payload word is
+// chosen to make the checksum equal to the ID while the ports keep the flow.
+func newUDPPacket(id, flow uint16, port int, src, dst net.IP, ttl int) []byte {
+	p := newUDPHeader(id, flow, port)
+	n := len(p)
+	p[n-2], p[n-1] = 0, 0
+	ph := make([]byte, 0, 12)
+	ph = append(ph, src.To4()...)
+	ph = append(ph, dst.To4()...)
+	ph = append(ph, 0, ProtocolUDP, byte(n>>8), byte(n))
+	// everything but the checksum field must sum up to ^id
+	sum := uint32(checksum(ph, p)) + uint32(^id)
+	sum = sum&0xffff + sum>>16
+	binary.BigEndian.PutUint16(p[n-2:], uint16(sum))
+	binary.BigEndian.PutUint16(p[6:8], id)
+	ip := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(p),
+		TOS:      16,
+		ID:       int(id),
+		Src:      src,
+		Dst:      dst,
+		Protocol: ProtocolUDP,
+		TTL:      ttl,
+	}
+	buf, err := ip.Marshal()
+	if err != nil {
+		return nil
+	}
+	return append(buf, p...)
+}
+
+// newUDPHeader builds a UDP datagram from source port flow to port, the payload
+// carries the probe ID. The checksum is left zero, newUDPPacket sets it for
+// IPv4 and the kernel fills it for IPv6.
+func newUDPHeader(id, flow uint16, port int) []byte {
+	b := make([]byte, udpHeaderLen, udpHeaderLen+4)
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = append(b, flowData(id)...)
+	binary.BigEndian.PutUint16(b[0:2], flow)
+	binary.BigEndian.PutUint16(b[2:4], uint16(port))
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+	return b
+}
+
+// newTCPPacket builds an IPv4 TCP SYN probe.
+func newTCPPacket(id, flow uint16, port int, src, dst net.IP, ttl int) []byte {
+	p := newTCPHeader(id, flow, port, src, dst)
+	ip := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(p),
+		TOS:      16,
+		ID:       int(id),
+		Src:      src,
+		Dst:      dst,
+		Protocol: ProtocolTCP,
+		TTL:      ttl,
+	}
+	buf, err := ip.Marshal()
+	if err != nil {
+		return nil
+	}
+	return append(buf, p...)
+}
+
+// newTCPHeader builds a TCP SYN segment from source port flow to port, the
+// sequence number carries the probe ID. The IPv4 checksum is computed
+// from src and dst, it is left for the kernel if they are nil.
+func newTCPHeader(id, flow uint16, port int, src, dst net.IP) []byte {
+	b := make([]byte, tcpHeaderLen)
+	binary.BigEndian.PutUint16(b[0:2], flow)
+	binary.BigEndian.PutUint16(b[2:4], uint16(port))
+	binary.BigEndian.PutUint32(b[4:8], uint32(id))
+	b[12] = tcpHeaderLen / 4 << 4
+	b[13] = tcpFlagSYN
+	binary.BigEndian.PutUint16(b[14:16], 65535)
+	if src != nil && dst != nil {
+		ph := make([]byte, 0, 12)
+		ph = append(ph, src.To4()...)
+		ph = append(ph, dst.To4()...)
+		ph = append(ph, 0, ProtocolTCP, 0, tcpHeaderLen)
+		binary.BigEndian.PutUint16(b[16:18], checksum(ph, b))
+	}
+	return b
+}
+
+// flowData returns the complement of id. Sent right after a field holding id,
+// it keeps the checksum of the probe constant whatever the ID is.
+func flowData(id uint16) []byte {
+	return []byte{byte(^id >> 8), byte(^id)}
+}
+
+// checksum returns the internet checksum of the concatenated byte slices,
+// each slice must have an even length except the last one.
+func checksum(bs ...[]byte) uint16 {
+	var sum uint32
+	for _, b := range bs {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+const (
+	udpHeaderLen = 8
+	tcpHeaderLen = 20
+	tcpFlagSYN   = 0x02
+	tcpFlagRST   = 0x04
+	tcpFlagACK   = 0x10
+)
+
 // IANA Assigned Internet Protocol Numbers
 const (
 	ProtocolICMP     = 1
@@ -393,6 +1038,8 @@ type Reply struct {
 	IP   net.IP
 	RTT  time.Duration
 	Hops int
+	// Flow is the flow identifier given to PingFlow.
+	Flow uint16
 }
 
 // Node is a detected network node.
@@ -426,21 +1073,62 @@ func (h *Hop) Add(r *Reply) *Node {
 
 // Trace is a simple traceroute tool using DefaultTracer.
 func Trace(ip net.IP) ([]*Hop, error) {
+	return TraceContext(context.Background(), ip)
+}
+
+// TraceContext is like Trace but stops when ctx is done. The hops detected
+// so far are returned along with ctx.Err() in that case.
+func TraceContext(ctx context.Context, ip net.IP) ([]*Hop, error) {
+	return TraceContextFunc(ctx, ip, nil)
+}
+
+// TraceContextFunc is like TraceContext and also calls onHop with a copy of
+// each hop in order of distance as replies arrive. Replies may be reordered,
+// so a hop without replies is passed with no nodes only after two farther
+// hops have replied or the trace has ended. Replies arriving after their hop
+// has been passed are only kept in the returned hops.
+func TraceContextFunc(ctx context.Context, ip net.IP, onHop func(hop *Hop)) ([]*Hop, error) {
 	hops := make([]*Hop, 0, DefaultTracer.MaxHops)
-	touch := func(dist int) *Hop {
+	find := func(dist int) *Hop {
 		for _, h := range hops {
 			if h.Distance == dist {
 				return h
 			}
 		}
+		return nil
+	}
+	touch := func(dist int) *Hop {
+		if h := find(dist); h != nil {
+			return h
+		}
 		h := &Hop{Distance: dist}
 		hops = append(hops, h)
 		return h
 	}
-	err := DefaultTracer.Trace(context.Background(), ip, func(r *Reply) {
+	// PingFlow skips the first hop, so distances start at 2.
+	next, farthest, done := 2, 0, false
+	emit := func(upto int) {
+		for ; onHop != nil && !done && next <= upto; next++ {
+			h := &Hop{Distance: next}
+			if it := find(next); it != nil {
+				for _, n := range it.Nodes {
+					h.Nodes = append(h.Nodes, &Node{IP: n.IP, RTT: append([]time.Duration(nil), n.RTT...)})
+				}
+			}
+			onHop(h)
+			done = len(h.Nodes) == 1 && ip.Equal(h.Nodes[0].IP)
+		}
+	}
+	err := DefaultTracer.Trace(ctx, ip, func(r *Reply) {
 		touch(r.Hops).Add(r)
+		farthest = max(farthest, r.Hops)
+		upto := max(next-1, farthest-2)
+		for find(upto+1) != nil {
+			upto++
+		}
+		emit(upto)
 	})
-	if err != nil && err != context.DeadlineExceeded {
+	if err != nil && err != ctx.Err() {
 		return nil, err
 	}
 	sort.Slice(hops, func(i, j int) bool {
@@ -464,5 +1152,8 @@ func Trace(ip net.IP) ([]*Hop, error) {
 		hops = hops[:i]
 		break
 	}
-	return hops, nil
+	if len(hops) > 0 {
+		emit(hops[len(hops)-1].Distance)
+	}
+	return hops, err
 }
@@ -0,0 +1,226 @@
+package backtrace
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// simRoute 构造一条模拟路由，每一跳只有一个地址
+func simRoute(dst string, ips ...string) SimRoute {
+	r := SimRoute{Dst: dst, RTT: 3 * time.Millisecond}
+	for _, ip := range ips {
+		r.Hops = append(r.Hops, SimHop{IPs: []string{ip}, RTT: time.Millisecond})
+	}
+	return r
+}
+
+func newSimTracer(probe string, routes ...SimRoute) *Tracer {
+	c := DefaultConfig
+	c.Delay = 5 * time.Millisecond
+	c.Timeout = 100 * time.Millisecond
+	c.Probe = probe
+	c.Addr = &net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	c.Transport = NewSimNetwork(routes...)
+	return &Tracer{Config: c}
+}
+
+// traceIPs 返回按跳数排序的路由节点，到达目标后的重复应答被忽略
+func traceIPs(t *testing.T, tr *Tracer, dst string) []string {
+	hops := make(map[int]string)
+	err := tr.Trace(context.Background(), net.ParseIP(dst), func(r *Reply) {
+		if _, ok := hops[r.Hops]; !ok {
+			hops[r.Hops] = r.IP.String()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Trace(%s) error: %v", dst, err)
+	}
+	var dists []int
+	for d := range hops {
+		dists = append(dists, d)
+	}
+	sort.Ints(dists)
+	var ips []string
+	for _, d := range dists {
+		ips = append(ips, hops[d])
+		if hops[d] == net.ParseIP(dst).String() {
+			break
+		}
+	}
+	return ips
+}
+
+func TestTraceSim(t *testing.T) {
+	routes := []SimRoute{
+		simRoute("219.141.140.10", "10.0.0.1", "59.43.1.1", "202.97.1.1", "219.141.1.1"),
+		simRoute("240e:0:a::c9:5238", "fd00::1", "240e:1::1", "240e:2::1"),
+	}
+	want := map[string][]string{
+		"219.141.140.10":    {"59.43.1.1", "202.97.1.1", "219.141.1.1", "219.141.140.10"},
+		"240e:0:a::c9:5238": {"240e:1::1", "240e:2::1", "240e:0:a::c9:5238"},
+	}
+	for _, probe := range []string{ProbeICMP, ProbeUDP, ProbeTCP} {
+		tr := newSimTracer(probe, routes...)
+		for dst, ips := range want {
+			got := traceIPs(t, tr, dst)
+			if len(got) != len(ips) {
+				t.Fatalf("%s %s: got hops %v; want %v", probe, dst, got, ips)
+			}
+			for i := range ips {
+				if got[i] != ips[i] {
+					t.Errorf("%s %s: got hops %v; want %v", probe, dst, got, ips)
+					break
+				}
+			}
+		}
+		tr.Close()
+	}
+}
+
+func TestTraceParisSim(t *testing.T) {
+	route := simRoute("202.96.209.133", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	route.Hops[1].IPs = []string{"59.43.1.1", "202.97.1.1", "202.97.2.1", "59.43.2.1"}
+	for _, paris := range []bool{false, true} {
+		tr := newSimTracer(ProbeUDP, route)
+		tr.Paris = paris
+		tr.Count = 8
+		nodes := make(map[string]bool)
+		err := tr.Trace(context.Background(), net.ParseIP(route.Dst), func(r *Reply) {
+			if r.Hops == 2 {
+				nodes[r.IP.String()] = true
+			}
+		})
+		tr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paris && len(nodes) != 1 {
+			t.Errorf("paris: got %d nodes at the load balanced hop; want 1", len(nodes))
+		}
+		if !paris && len(nodes) < 2 {
+			t.Errorf("classic: got %d nodes at the load balanced hop; want more than 1", len(nodes))
+		}
+	}
+}
+
+func TestTraceMultipathSim(t *testing.T) {
+	route := simRoute("202.96.209.133", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4")
+	route.Hops[2].IPs = []string{"59.43.1.1", "202.97.1.1"}
+	tr := newSimTracer(ProbeICMP, route)
+	defer tr.Close()
+	m, err := tr.TraceMultipath(context.Background(), net.ParseIP(route.Dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsDiamond() {
+		t.Fatal("no load balancer found")
+	}
+	branches := 0
+	for _, l := range m.Links {
+		if l.From.String() == "10.0.0.2" {
+			branches++
+		}
+	}
+	if branches != 2 {
+		t.Errorf("got %d links from 10.0.0.2; want 2", branches)
+	}
+	// 跳数与 Trace 一致，负载均衡的第3个路由节点位于第3跳
+	for _, h := range m.Hops {
+		if len(h.Nodes) == 2 && h.Distance != 3 {
+			t.Errorf("load balanced hop at distance %d; want 3", h.Distance)
+		}
+	}
+}
+
+func TestTraceLossSim(t *testing.T) {
+	route := simRoute("61.139.2.69", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	route.Hops[1].Loss = 1
+	tr := newSimTracer(ProbeICMP, route)
+	defer tr.Close()
+	got := traceIPs(t, tr, route.Dst)
+	for _, ip := range got {
+		if ip == "10.0.0.2" {
+			t.Errorf("lossy hop answered: %v", got)
+		}
+	}
+	if len(got) == 0 || got[len(got)-1] != route.Dst {
+		t.Errorf("destination not reached: %v", got)
+	}
+}
+
+func TestReachableSim(t *testing.T) {
+	var ips []string
+	for i := 1; i <= DefaultConfig.MaxHops+5; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.0.%d", i))
+	}
+	far := simRoute("61.139.2.69", ips...)
+	tr := newSimTracer(ProbeICMP, far)
+	defer tr.Close()
+	ok, err := tr.Reachable(context.Background(), net.ParseIP(far.Dst), 100*time.Millisecond)
+	if err != nil || !ok {
+		t.Errorf("target %d hops away: got %v %v; want reachable", len(ips)+1, ok, err)
+	}
+}
+
+func TestTraceContextFuncSim(t *testing.T) {
+	route := simRoute("61.139.2.69", "10.0.0.1", "10.0.0.2", "10.0.0.3", "202.97.1.1")
+	route.Hops[2].Loss = 1
+	withSimTracer(t, route)
+	var got []string
+	hops, err := TraceContextFunc(context.Background(), net.ParseIP(route.Dst), func(h *Hop) {
+		ip := "*"
+		if len(h.Nodes) > 0 {
+			ip = h.Nodes[0].IP.String()
+		}
+		got = append(got, fmt.Sprintf("%d %s", h.Distance, ip))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2 10.0.0.2", "3 *", "4 202.97.1.1", "5 61.139.2.69"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("streamed %v; want %v", got, want)
+	}
+	if len(hops) != 3 {
+		t.Errorf("got %d hops; want 3", len(hops))
+	}
+}
+
+func TestServeTCPPort(t *testing.T) {
+	tr := &Tracer{Config: Config{Probe: ProbeTCP}}
+	synAck := func(port uint16) []byte {
+		b := newTCPHeader(7, 40000, int(port), nil, nil)
+		b[0], b[1], b[2], b[3] = b[2], b[3], b[0], b[1]
+		b[13] = tcpFlagSYN | tcpFlagACK
+		b[8], b[9], b[10], b[11] = 0, 0, 0, 8
+		return b
+	}
+	if err := tr.serveTCP(net.ParseIP("192.0.2.10"), synAck(80)); err != nil {
+		t.Errorf("answer from the probed port rejected: %v", err)
+	}
+	if err := tr.serveTCP(net.ParseIP("192.0.2.10"), synAck(443)); err != errUnsupportedProtocol {
+		t.Errorf("answer from another port accepted: %v", err)
+	}
+}
+
+func TestUDPPacketChecksum(t *testing.T) {
+	src, dst := net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.7")
+	for _, id := range []uint16{1, 2, 0x1234, 0xfffe, 0xffff} {
+		b := newUDPPacket(id, 40000, 33434, src, dst, 5)
+		p := b[ipv4.HeaderLen:]
+		ph := append(append(append([]byte{}, src.To4()...), dst.To4()...), 0, ProtocolUDP, 0, byte(len(p)))
+		if c := checksum(ph, p); c != 0 {
+			t.Errorf("id %#x: bad udp checksum, got %#x", id, c)
+		}
+		if got, err := quotedID(ProtocolUDP, p[:8]); err != nil || got != id {
+			t.Errorf("id %#x: quotedID = %#x, %v", id, got, err)
+		}
+	}
+}
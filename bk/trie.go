@@ -0,0 +1,87 @@
+package backtrace
+
+import (
+	"fmt"
+	"net"
+)
+
+// Prefix 一个地址段及其所属的ASN信息
+type Prefix struct {
+	CIDR    string `json:"cidr" yaml:"cidr"`       // 地址段，如 59.43.0.0/16
+	ASN     string `json:"asn" yaml:"asn"`         // 所属ASN，如 AS4809
+	Carrier string `json:"carrier" yaml:"carrier"` // 运营商，如 电信
+	Tier    string `json:"tier" yaml:"tier"`       // 线路等级，为空时由整条路由判断，如CN2需要区分GT和GIA
+}
+
+// prefixTrie 按地址位逐位分支的前缀树，查询时返回最长匹配的地址段
+// IPV4和IPV6分开存储，查询耗时只与地址长度有关，与地址段数量无关
+type prefixTrie struct {
+	root4 *trieNode
+	root6 *trieNode
+}
+
+type trieNode struct {
+	child  [2]*trieNode
+	prefix *Prefix
+}
+
+// newPrefixTrie 由地址段列表构建前缀树
+func newPrefixTrie(prefixes []Prefix) (*prefixTrie, error) {
+	t := &prefixTrie{root4: &trieNode{}, root6: &trieNode{}}
+	for _, p := range prefixes {
+		if err := t.insert(p); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// insert 插入一个地址段，相同地址段重复插入时后者覆盖前者
+func (t *prefixTrie) insert(p Prefix) error {
+	_, ipnet, err := net.ParseCIDR(p.CIDR)
+	if err != nil {
+		return fmt.Errorf("invalid prefix %q: %v", p.CIDR, err)
+	}
+	ones, _ := ipnet.Mask.Size()
+	node, ip := t.root(ipnet.IP)
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if node.child[b] == nil {
+			node.child[b] = &trieNode{}
+		}
+		node = node.child[b]
+	}
+	node.prefix = &p
+	return nil
+}
+
+// lookup 返回包含 ip 的最长地址段，没有匹配时返回 nil
+func (t *prefixTrie) lookup(ip net.IP) *Prefix {
+	if ip == nil {
+		return nil
+	}
+	node, ip := t.root(ip)
+	var match *Prefix
+	for i := 0; node != nil; i++ {
+		if node.prefix != nil {
+			match = node.prefix
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.child[bit(ip, i)]
+	}
+	return match
+}
+
+// root 返回地址对应的根节点，IPV4地址统一使用4字节形式
+func (t *prefixTrie) root(ip net.IP) (*trieNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.root4, ip4
+	}
+	return t.root6, ip.To16()
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,54 @@
+package backtrace
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIpAsn(t *testing.T) {
+	cases := map[string]string{
+		"59.43.1.1":        "AS4809",
+		"59.4.31.1":        "",
+		"223.120.165.1":    "AS58807",
+		"223.120.191.254":  "AS58807",
+		"223.120.16.1":     "AS58453",
+		"223.120.150.1":    "AS58453",
+		"223.119.8.1":      "AS58453",
+		"223.122.0.1":      "",
+		"202.97.224.69":    "AS4837",
+		"202.97.200.1":     "AS4134",
+		"240e:1::1":        "AS4134",
+		"2409:8080::1":     "AS9808",
+		"2400::1":          "",
+		"::ffff:59.43.1.1": "AS4809",
+		"not an ip":        "",
+	}
+	for ip, want := range cases {
+		if got := ipAsn(ip); got != want {
+			t.Errorf("ipAsn(%q) = %q; want %q", ip, got, want)
+		}
+	}
+}
+
+func TestPrefixTrieLongestMatch(t *testing.T) {
+	tr, err := newPrefixTrie([]Prefix{
+		{CIDR: "10.0.0.0/8", ASN: "A"},
+		{CIDR: "10.1.0.0/16", ASN: "B"},
+		{CIDR: "10.1.2.0/24", ASN: "C"},
+		{CIDR: "0.0.0.0/0", ASN: "D"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{"10.1.2.3": "C", "10.1.3.3": "B", "10.2.0.1": "A", "11.0.0.1": "D"} {
+		if p := tr.lookup(net.ParseIP(ip)); p == nil || p.ASN != want {
+			t.Errorf("lookup(%s) = %v; want %s", ip, p, want)
+		}
+	}
+	if p := tr.lookup(net.ParseIP("::1")); p != nil {
+		t.Errorf("lookup(::1) = %v; want nil", p)
+	}
+	if _, err := newPrefixTrie([]Prefix{{CIDR: "10.0.0.0/33"}}); err == nil {
+		t.Error("invalid prefix accepted")
+	}
+}
@@ -1,5 +1,35 @@
 package backtrace
 
+import "time"
+
 const BackTraceVersion = "v0.0.4"
 
 var EnableLoger = false
+
+// EnableIPv4 和 EnableIPv6 控制 BackTrace 检测的目标地址类型
+var (
+	EnableIPv4 = true
+	EnableIPv6 = false
+)
+
+// EnableExtra 控制 BackTrace 是否同时检测教育网、科技网、广电等其他运营商的目标
+var EnableExtra = false
+
+// Timeout、TargetTimeout 和 Preflight 控制 BackTrace 的整体超时、单个目标的超时和预检的超时
+var (
+	Timeout       = DefaultTimeout
+	TargetTimeout time.Duration
+	Preflight     = DefaultPreflight
+)
+
+// Preset 和 Targets 控制 BackTrace 检测的目标，设置 Targets 时不使用内置目标组
+var (
+	Preset  = DefaultPreset
+	Targets []Target
+)
+
+// EnableDetail 控制 BackTrace 是否逐个检测目标并实时输出每一跳的地址、ASN和延迟
+var EnableDetail = false
+
+// EnableMultipath 控制 BackTrace 是否枚举负载均衡的各条路径，并分别输出每条分支的线路
+var EnableMultipath = false
@@ -0,0 +1,115 @@
+package backtrace
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	xdbHeaderLen     = 256
+	xdbVectorCols    = 256
+	xdbVectorLen     = 8
+	xdbSegmentLen    = 14
+	xdbVectorIndexed = xdbHeaderLen + 256*xdbVectorCols*xdbVectorLen
+)
+
+// xdbISPs ip2region 只提供运营商名称，按运营商对应到其主要的ASN
+var xdbISPs = map[string]string{
+	"电信":  "AS4134",
+	"联通":  "AS4837",
+	"移动":  "AS9808",
+	"铁通":  "AS9394",
+	"教育网": "AS4538",
+}
+
+// XDBSource 读取 ip2region 的 xdb 格式数据库，仅支持IPV4
+// 数据库中的地区信息为 国家|区域|省份|城市|运营商，ASN 和 Carrier 由运营商名称推断，Prefix 为地址范围
+type XDBSource struct {
+	buf []byte
+}
+
+// OpenXDB 将 xdb 数据库文件整个读入内存
+func OpenXDB(path string) (*XDBSource, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < xdbVectorIndexed {
+		return nil, fmt.Errorf("invalid xdb file %q: too short", path)
+	}
+	return &XDBSource{buf: buf}, nil
+}
+
+// Lookup 实现 ASNSource
+func (s *XDBSource) Lookup(ip net.IP) (*ASNInfo, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, nil
+	}
+	v := binary.BigEndian.Uint32(ip4)
+	idx := xdbHeaderLen + (int(ip4[0])*xdbVectorCols+int(ip4[1]))*xdbVectorLen
+	start := int(binary.LittleEndian.Uint32(s.buf[idx:]))
+	end := int(binary.LittleEndian.Uint32(s.buf[idx+4:]))
+	if start == 0 {
+		return nil, nil
+	}
+	if end > len(s.buf)-xdbSegmentLen || start > end {
+		return nil, errors.New("invalid xdb vector index")
+	}
+	// 二分查找地址所在的段
+	for l, h := 0, (end-start)/xdbSegmentLen; l <= h; {
+		m := (l + h) / 2
+		p := s.buf[start+m*xdbSegmentLen:]
+		sip, eip := binary.LittleEndian.Uint32(p), binary.LittleEndian.Uint32(p[4:])
+		switch {
+		case v < sip:
+			h = m - 1
+		case v > eip:
+			l = m + 1
+		default:
+			n, ptr := int(binary.LittleEndian.Uint16(p[8:])), int(binary.LittleEndian.Uint32(p[10:]))
+			if ptr+n > len(s.buf) {
+				return nil, errors.New("invalid xdb segment index")
+			}
+			return xdbInfo(string(s.buf[ptr:ptr+n]), sip, eip), nil
+		}
+	}
+	return nil, nil
+}
+
+// xdbInfo 解析 国家|区域|省份|城市|运营商 格式的地区信息，0 表示未知
+func xdbInfo(region string, sip, eip uint32) *ASNInfo {
+	fields := strings.Split(region, "|")
+	for i := range fields {
+		if fields[i] == "0" {
+			fields[i] = ""
+		}
+	}
+	info := &ASNInfo{Prefix: fmt.Sprintf("%v-%v", uint32IP(sip), uint32IP(eip))}
+	if len(fields) > 0 {
+		info.Country = fields[0]
+	}
+	if len(fields) > 4 {
+		info.Org = fields[4]
+		if asn, ok := xdbISPs[fields[4]]; ok {
+			info.ASN, info.Carrier = asn, fields[4]
+		}
+	}
+	return info
+}
+
+func uint32IP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// Close 实现 ASNSource
+func (s *XDBSource) Close() error {
+	s.buf = nil
+	return nil
+}
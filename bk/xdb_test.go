@@ -0,0 +1,71 @@
+package backtrace
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeXDB 生成只包含 1.2.0.0-1.2.3.255 和 1.2.4.0-1.2.255.255 两段的 xdb 文件
+func writeXDB(t *testing.T) string {
+	regions := []string{"中国|0|北京|北京市|联通", "美国|0|0|0|Example"}
+	buf := make([]byte, xdbVectorIndexed)
+	segStart := len(buf)
+	buf = append(buf, make([]byte, 2*xdbSegmentLen)...)
+	for i, r := range regions {
+		p := buf[segStart+i*xdbSegmentLen:]
+		sip, eip := uint32(0x01020000), uint32(0x010203ff)
+		if i == 1 {
+			sip, eip = 0x01020400, 0x0102ffff
+		}
+		binary.LittleEndian.PutUint32(p, sip)
+		binary.LittleEndian.PutUint32(p[4:], eip)
+		binary.LittleEndian.PutUint16(p[8:], uint16(len(r)))
+		binary.LittleEndian.PutUint32(p[10:], uint32(len(buf)))
+		buf = append(buf, r...)
+	}
+	idx := xdbHeaderLen + (1*xdbVectorCols+2)*xdbVectorLen
+	binary.LittleEndian.PutUint32(buf[idx:], uint32(segStart))
+	binary.LittleEndian.PutUint32(buf[idx+4:], uint32(segStart+xdbSegmentLen))
+	path := filepath.Join(t.TempDir(), "test.xdb")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestXDBSource(t *testing.T) {
+	s, err := OpenASNDB(writeXDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cases := map[string]*ASNInfo{
+		"1.2.3.4":   {ASN: "AS4837", Org: "联通", Country: "中国", Prefix: "1.2.0.0-1.2.3.255", Carrier: "联通"},
+		"1.2.200.1": {Org: "Example", Country: "美国", Prefix: "1.2.4.0-1.2.255.255"},
+		"1.3.0.1":   nil,
+		"2001::1":   nil,
+	}
+	for ip, want := range cases {
+		got, err := s.Lookup(net.ParseIP(ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == nil) != (want == nil) || got != nil && *got != *want {
+			t.Errorf("Lookup(%s) = %+v; want %+v", ip, got, want)
+		}
+	}
+
+	SetASNSource(s)
+	defer SetASNSource(nil)
+	// 数据源的ASN只用于展示，不参与线路判断
+	hops := testHops("1.2.3.4", 10, "202.97.1.1", 20)
+	if asns := hopASNs(hops, currentRules()); len(asns) != 1 || asns[0] != "AS4134" {
+		t.Errorf("got asns %v", asns)
+	}
+	if info, _ := getASNInfo("1.2.3.4"); info == nil || info.ASN != "AS4837" {
+		t.Errorf("getASNInfo(1.2.3.4) = %+v", info)
+	}
+}
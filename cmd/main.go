@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"strings"
 
 	backtrace "github.com/oneclickvirt/backtrace/bk"
 	. "github.com/oneclickvirt/defaultset"
@@ -20,17 +21,59 @@ type IpInfo struct {
 	Org     string `json:"org"`
 }
 
+// targetList 可重复指定的 -t 参数
+type targetList []backtrace.Target
+
+func (l *targetList) String() string {
+	var ips []string
+	for _, t := range *l {
+		ips = append(ips, t.IP)
+	}
+	return strings.Join(ips, " ")
+}
+
+func (l *targetList) Set(s string) error {
+	t, err := backtrace.ParseTarget(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, t)
+	return nil
+}
+
 func main() {
 	go func() {
 		http.Get("https://hits.seeyoufarm.com/api/count/incr/badge.svg?url=https%3A%2F%2Fgithub.com%2Foneclickvirt%2Fbacktrace&count_bg=%2323E01C&title_bg=%23555555&icon=sonarcloud.svg&icon_color=%23E7E7E7&title=hits&edge_flat=false")
 	}()
 	fmt.Println(Green("项目地址:"), Yellow("https://github.com/oneclickvirt/backtrace"))
-	var showVersion, showIpInfo, help bool
+	var showVersion, showIpInfo, help, checkRules, cymru bool
+	var ipVersion, rulesFile, targetsFile, asnDB, cymruDNS, engine, geoSource string
+	var targets targetList
 	backtraceFlag := flag.NewFlagSet("backtrace", flag.ContinueOnError)
 	backtraceFlag.BoolVar(&help, "h", false, "Show help information")
 	backtraceFlag.BoolVar(&showVersion, "v", false, "Show version")
 	backtraceFlag.BoolVar(&showIpInfo, "s", true, "Disabe show ip info")
 	backtraceFlag.BoolVar(&backtrace.EnableLoger, "e", false, "Enable logging")
+	backtraceFlag.StringVar(&ipVersion, "ipv", "4", "IP version to test: 4, 6 or both")
+	backtraceFlag.BoolVar(&backtrace.EnableExtra, "extra", false, "Also test CERNET, CSTNET and Broadnet targets")
+	backtraceFlag.BoolVar(&backtrace.EnableMultipath, "multipath", false, "Enumerate load balanced paths with the local tracer and classify each branch, ignores -engine and -detail, may need a longer -timeout")
+	backtraceFlag.BoolVar(&backtrace.EnableDetail, "detail", false, "Trace targets one by one and print each hop with its ASN and RTT as replies arrive, -timeout then limits each target")
+	backtraceFlag.StringVar(&backtrace.Preset, "preset", backtrace.DefaultPreset, "Built-in target preset: "+strings.Join(backtrace.Presets(), ", "))
+	backtraceFlag.StringVar(&targetsFile, "targets", "", "Load targets from a file, one \"name,ip,carrier,region\" per line, instead of the built-in preset")
+	backtraceFlag.Var(&targets, "t", "Target as \"name,ip|alternate,carrier,region\" or just ip, can be repeated, replaces the built-in preset")
+	backtraceFlag.StringVar(&engine, "engine", "nexttrace", "Trace engine: nexttrace, falling back to the local tracer when it fails, or local")
+	backtraceFlag.StringVar(&geoSource, "geo", backtrace.DefaultGeoSource, "IP info source of nexttrace for hop ASNs, such as IPInfo or IP-API.com, off if empty, online sources receive every hop IP")
+	backtraceFlag.StringVar(&backtrace.DefaultTracer.Probe, "probe", backtrace.ProbeICMP, "Probe type: icmp, udp or tcp")
+	backtraceFlag.BoolVar(&backtrace.DefaultTracer.Paris, "paris", false, "Keep the flow identifier constant like paris-traceroute")
+	backtraceFlag.IntVar(&backtrace.DefaultTracer.Port, "port", 0, "Destination port of udp and tcp probes, 33434 for udp and 80 for tcp if not set")
+	backtraceFlag.DurationVar(&backtrace.Timeout, "timeout", backtrace.DefaultTimeout, "Overall timeout of the test")
+	backtraceFlag.DurationVar(&backtrace.Preflight, "preflight", backtrace.DefaultPreflight, "Timeout of the reachability check which picks a responsive alternate target, negative to disable")
+	backtraceFlag.DurationVar(&backtrace.TargetTimeout, "target-timeout", 0, "Timeout of each target, only limited by -timeout if not set")
+	backtraceFlag.StringVar(&rulesFile, "rules", "", "Load line classification rules from a yaml or json file instead of the built-in rules")
+	backtraceFlag.StringVar(&asnDB, "asndb", "", "Local ASN database for hops outside the backbone rules, GeoLite2-ASN .mmdb or ip2region .xdb")
+	backtraceFlag.BoolVar(&cymru, "cymru", false, "Look up ASNs of hops outside the backbone rules through Team Cymru DNS, cached on disk, after -asndb if both are set")
+	backtraceFlag.StringVar(&cymruDNS, "cymru-dns", "", "DNS server used by -cymru, the system resolver if not set")
+	backtraceFlag.BoolVar(&checkRules, "check-rules", false, "Validate the classification rules, report overlapping or shadowed prefixes and exit")
 	backtraceFlag.Parse(os.Args[1:])
 	if help {
 		fmt.Printf("Usage: %s [options]\n", os.Args[0])
@@ -41,15 +84,102 @@ func main() {
 		fmt.Println(backtrace.BackTraceVersion)
 		return
 	}
+	rules := backtrace.DefaultRules()
+	if rulesFile != "" {
+		var err error
+		rules, err = backtrace.LoadRules(rulesFile)
+		if err != nil {
+			fmt.Println(Red(err.Error()))
+			return
+		}
+	}
+	if checkRules {
+		warnings, err := rules.Validate()
+		for _, w := range warnings {
+			fmt.Println(Yellow(w))
+		}
+		if err != nil {
+			fmt.Println(Red(err.Error()))
+			return
+		}
+		fmt.Println(Green(fmt.Sprintf("%d prefixes, %d lines, %d warnings", len(rules.Prefixes), len(rules.Lines), len(warnings))))
+		return
+	}
+	if err := backtrace.SetRules(rules); err != nil {
+		fmt.Println(Red(err.Error()))
+		return
+	}
+	// 同时指定时先查本地数据库，未收录的地址再通过 Team Cymru 查询
+	var sources backtrace.ChainSource
+	if asnDB != "" {
+		src, err := backtrace.OpenASNDB(asnDB)
+		if err != nil {
+			fmt.Println(Red(err.Error()))
+			return
+		}
+		sources = append(sources, src)
+	}
+	if cymru {
+		src, err := backtrace.NewCymruSource(cymruDNS, backtrace.DefaultCymruCache(), 0)
+		if err != nil {
+			fmt.Println(Red(err.Error()))
+			return
+		}
+		sources = append(sources, src)
+	}
+	if len(sources) > 0 {
+		defer sources.Close()
+		backtrace.SetASNSource(sources)
+	}
+	switch engine {
+	case "nexttrace":
+		// NextTrace 不能固定探测包的流标识，-paris 时只使用本地路由检测
+		if backtrace.DefaultTracer.Paris {
+			backtrace.DefaultEngine = backtrace.LocalEngine{}
+			break
+		}
+		if geoSource != "" {
+			if err := backtrace.CheckGeoSource(geoSource); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		backtrace.DefaultEngine = backtrace.FallbackEngine{backtrace.NTraceEngine{GeoSource: geoSource}, backtrace.LocalEngine{}}
+	case "local":
+		backtrace.DefaultEngine = backtrace.LocalEngine{}
+	default:
+		fmt.Printf("Invalid -engine value %q, must be nexttrace or local\n", engine)
+		return
+	}
+	switch ipVersion {
+	case "4":
+		backtrace.EnableIPv4, backtrace.EnableIPv6 = true, false
+	case "6":
+		backtrace.EnableIPv4, backtrace.EnableIPv6 = false, true
+	case "both":
+		backtrace.EnableIPv4, backtrace.EnableIPv6 = true, true
+	default:
+		fmt.Printf("Invalid -ipv value %q, must be 4, 6 or both\n", ipVersion)
+		return
+	}
+	if targetsFile != "" {
+		list, err := backtrace.LoadTargets(targetsFile)
+		if err != nil {
+			fmt.Println(Red(err.Error()))
+			return
+		}
+		backtrace.Targets = append(backtrace.Targets, list...)
+	}
+	backtrace.Targets = append(backtrace.Targets, targets...)
 	if showIpInfo {
 		rsp, err := http.Get("http://ipinfo.io")
 		if err != nil {
-			fmt.Errorf("Get ip info err %v \n", err.Error())
+			fmt.Printf("Get ip info err %v \n", err.Error())
 		} else {
 			info := IpInfo{}
 			err = json.NewDecoder(rsp.Body).Decode(&info)
 			if err != nil {
-				fmt.Errorf("json decode err %v \n", err.Error())
+				fmt.Printf("json decode err %v \n", err.Error())
 			} else {
 				fmt.Println(Green("国家: ") + White(info.Country) + Green(" 城市: ") + White(info.City) +
 					Green(" 服务商: ") + Blue(info.Org))
@@ -58,7 +188,6 @@ func main() {
 	}
 	backtrace.BackTrace()
 	fmt.Println(Yellow("准确线路自行查看详细路由，本测试结果仅作参考"))
-	fmt.Println(Yellow("同一目标地址多个线路时，可能检测已越过汇聚层，除了第一个线路外，后续信息可能无效"))
 	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
 		fmt.Println("Press Enter to exit...")
 		fmt.Scanln()